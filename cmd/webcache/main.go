@@ -0,0 +1,487 @@
+package main
+
+import (
+	"../../webcache"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const USAGE = `Usage: webcache [-root dir] [-store flat|segment|bolt] <command> [arguments]
+
+Inspects and repairs a web cache directory. The proxy must not be running.
+
+Commands:
+  ls               List the cached entries
+  show <url|key>   Print the metadata and body of an entry
+  verify           Cross-check entries against the journal and mapping file
+  repair           Fix the inconsistencies reported by verify
+  purge <pattern>  Delete the entries whose URL matches a regular expression
+  stats            Summarize the cache contents
+  export [-match pattern] <file>
+                   Write the entries whose URL matches a regular expression,
+                   or all of them, to a WARC file, gzipped if it ends in .gz
+  import [-policy LRU|LFU] [-size MB] [-expiration seconds] [-max-entries n] <file>...
+                   Cache the responses of WARC files, or of HAR files if they
+                   end in .har, evicting entries as the proxy would with the
+                   same settings
+`
+
+type cacheDir struct {
+	root      string
+	store     webcache.Store
+	journaled bool
+}
+
+//Returned by commands given the wrong arguments
+var errUsage = errors.New("usage")
+
+type entryInfo struct {
+	key      string
+	response *webcache.Response
+	err      error
+}
+
+func main() {
+	root := flag.String("root", "cache", "Cache directory")
+	storeType := flag.String("store", webcache.FlatStoreType, "Disk cache storage backend, flat, segment or bolt")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, USAGE) }
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	os.Exit(run(*root, *storeType, args))
+}
+
+// run runs the command in args and returns the exit status. Commands return
+// their errors here rather than exiting, so that the store, and the disk
+// caches and indexes they open, are closed first.
+func run(root string, storeType string, args []string) int {
+	store, err := webcache.OpenStore(storeType, root)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer store.Close()
+	_, transactional := store.(webcache.TransactionalStore)
+	c := &cacheDir{root: root, store: store, journaled: !transactional}
+
+	switch {
+	case args[0] == "ls" && len(args) == 1:
+		err = c.list()
+	case args[0] == "show" && len(args) == 2:
+		err = c.show(args[1])
+	case args[0] == "verify" && len(args) == 1:
+		var problems []string
+		problems, err = c.verify()
+		if err == nil && len(problems) > 0 {
+			return 1
+		}
+	case args[0] == "repair" && len(args) == 1:
+		err = c.repair()
+	case args[0] == "purge" && len(args) == 2:
+		err = c.purge(args[1])
+	case args[0] == "stats" && len(args) == 1:
+		err = c.stats()
+	case args[0] == "export":
+		err = c.export(args[1:])
+	case args[0] == "import":
+		err = c.importWARC(args[1:])
+	default:
+		err = errUsage
+	}
+	if err == errUsage {
+		flag.Usage()
+		return 2
+	}
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
+
+func (c *cacheDir) journalFile() string {
+	return path.Join(c.root, webcache.JournalFilename)
+}
+
+func (c *cacheDir) journal() map[string]bool {
+	if !c.journaled {
+		return nil
+	}
+	return webcache.ReadJournal(c.journalFile())
+}
+
+func (c *cacheDir) mappings() (map[string]string, error) {
+	if m, ok := c.store.(webcache.MappingStore); ok {
+		return m.LoadMappings()
+	}
+	return webcache.ReadMappings(path.Join(c.root, webcache.MappingFilename))
+}
+
+// index starts an inverted index over the cache's mappings. Closing it
+// saves the mappings sent to it.
+func (c *cacheDir) index() *webcache.InvertedIndex {
+	index := &webcache.InvertedIndex{
+		Filename:   path.Join(c.root, webcache.MappingFilename),
+		Requests:   make(chan webcache.MappingRequest),
+		NewMapping: make(chan webcache.Mapping),
+	}
+	if m, ok := c.store.(webcache.MappingStore); ok {
+		index.Mappings = m
+	}
+	loaded := make(chan struct{})
+	go index.Run(loaded)
+	<-loaded
+	return index
+}
+
+func (c *cacheDir) entries() ([]*entryInfo, error) {
+	var entries []*entryInfo
+	err := c.store.Iterate(func(key string) error {
+		entry := &entryInfo{key: key}
+		b, err := c.store.Get(key)
+		if err == nil {
+			entry.response, err = webcache.DecodeEntry(b)
+		}
+		entry.err = err
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	return entries, nil
+}
+
+func (c *cacheDir) state(entry *entryInfo, journal map[string]bool) string {
+	if entry.err != nil {
+		return "corrupt"
+	}
+	if c.journaled {
+		acked, ok := journal[entry.key]
+		if !ok {
+			return "unjournaled"
+		}
+		if !acked {
+			return "pending"
+		}
+	}
+	if entry.response.ExpirationTime.Before(time.Now()) {
+		return "expired"
+	}
+	return "ok"
+}
+
+func (c *cacheDir) list() error {
+	journal := c.journal()
+	entries, err := c.entries()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tSTATE\tSIZE\tEXPIRES\tCONTENT TYPE\tURL")
+	for _, entry := range entries {
+		if entry.err != nil {
+			fmt.Fprintf(w, "%s\t%s\t-\t-\t-\t-\n", shortKey(entry.key), c.state(entry, journal))
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			shortKey(entry.key),
+			c.state(entry, journal),
+			webcache.BytesToMegabyte(len(entry.response.Body)),
+			entry.response.ExpirationTime.Format(time.RFC3339),
+			entry.response.ContentType,
+			entry.response.URL)
+	}
+	return w.Flush()
+}
+
+func (c *cacheDir) show(urlOrKey string) error {
+	key := urlOrKey
+	b, err := c.store.Get(key)
+	if err == webcache.ErrNotFound {
+		key = webcache.Hash(urlOrKey)
+		b, err = c.store.Get(key)
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("Unable to read %s: %s", urlOrKey, err))
+	}
+	response, err := webcache.DecodeEntry(b)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Unable to decode %s: %s", key, err))
+	}
+	state := c.state(&entryInfo{key: key, response: response}, c.journal())
+	fmt.Printf("Key: %s\nURL: %s\nState: %s\nContent-Type: %s\nExpires: %s\nSize: %d\n\n",
+		key, response.URL, state, response.ContentType, response.ExpirationTime.Format(time.RFC3339), len(response.Body))
+	_, err = os.Stdout.Write(response.Body)
+	return err
+}
+
+// verify prints and returns the inconsistencies between the stored entries,
+// the journal and the mappings.
+func (c *cacheDir) verify() ([]string, error) {
+	var problems []string
+	journal := c.journal()
+	mappings, err := c.mappings()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := c.entries()
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string]bool)
+	for _, entry := range entries {
+		stored[entry.key] = true
+		switch state := c.state(entry, journal); state {
+		case "corrupt":
+			problems = append(problems, fmt.Sprintf("%s: corrupt entry: %s", entry.key, entry.err))
+			continue
+		case "unjournaled", "pending":
+			problems = append(problems, fmt.Sprintf("%s: entry is %s in the journal", entry.key, state))
+		}
+		if _, ok := mappings[entry.key]; !ok && entry.response.URL != "" {
+			problems = append(problems, fmt.Sprintf("%s: no mapping for %s", entry.key, entry.response.URL))
+		}
+	}
+	for key, acked := range journal {
+		if acked && !stored[key] {
+			problems = append(problems, fmt.Sprintf("%s: acknowledged in the journal but missing from disk", key))
+		}
+	}
+
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	fmt.Printf("%d problems found\n", len(problems))
+	return problems, nil
+}
+
+func (c *cacheDir) repair() error {
+	//Reading the disk cache the way the proxy does on startup discards
+	//unjournaled and corrupt entries, migrates old entries and removes
+	//orphaned temporary files
+	dc := webcache.NewDiskCache(c.store, c.journalFile(), 0)
+	defer dc.Close()
+	readChannel := make(chan *webcache.DiskCacheEntry)
+	go dc.Read(readChannel)
+	stored := make(map[string]string)
+	for entry := range readChannel {
+		stored[entry.Key] = entry.URL
+	}
+
+	removed := 0
+	for key, acked := range c.journal() {
+		if _, ok := stored[key]; acked && !ok {
+			err := dc.Remove(key)
+			if err != nil {
+				return err
+			}
+			removed++
+		}
+	}
+
+	mappings, err := c.mappings()
+	if err != nil {
+		return err
+	}
+	index := c.index()
+	mapped := 0
+	for key, url := range stored {
+		if _, ok := mappings[key]; !ok && url != "" {
+			index.NewMapping <- webcache.Mapping{Original: url, Hashed: key}
+			mapped++
+		}
+	}
+	err = index.Close()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Kept %d entries, removed %d missing entries from the journal, restored %d mappings\n", len(stored), removed, mapped)
+	return nil
+}
+
+func (c *cacheDir) purge(pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	entries, err := c.entries()
+	if err != nil {
+		return err
+	}
+	dc := webcache.NewDiskCache(c.store, c.journalFile(), 0)
+	defer dc.Close()
+	purged := 0
+	for _, entry := range entries {
+		if entry.err == nil && re.MatchString(entry.response.URL) {
+			err := dc.Remove(entry.key)
+			if err != nil {
+				return err
+			}
+			fmt.Println(entry.response.URL)
+			purged++
+		}
+	}
+	fmt.Printf("Purged %d entries\n", purged)
+	return nil
+}
+
+func (c *cacheDir) stats() error {
+	journal := c.journal()
+	states := make(map[string]int)
+	types := make(map[string]int)
+	size := 0
+	entries, err := c.entries()
+	if err != nil {
+		return err
+	}
+	mappings, err := c.mappings()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		states[c.state(entry, journal)]++
+		if entry.err == nil {
+			size += len(entry.response.Body)
+			types[entry.response.ContentType] += len(entry.response.Body)
+		}
+	}
+
+	fmt.Printf("Entries: %d (%s)\n", len(entries), webcache.BytesToMegabyte(size))
+	for _, state := range []string{"ok", "expired", "pending", "unjournaled", "corrupt"} {
+		fmt.Printf("  %s: %d\n", state, states[state])
+	}
+	fmt.Println("Content types:")
+	var names []string
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return types[names[i]] > types[names[j]] })
+	for _, name := range names {
+		fmt.Printf("  %s: %s\n", name, webcache.BytesToMegabyte(types[name]))
+	}
+	if c.journaled {
+		fmt.Printf("Journal entries: %d\n", len(journal))
+	}
+	fmt.Printf("Mappings: %d\n", len(mappings))
+	return nil
+}
+
+func (c *cacheDir) export(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	match := flags.String("match", "", "Regular expression the exported URLs must match")
+	err := flags.Parse(args)
+	if err != nil || flags.NArg() != 1 {
+		return errUsage
+	}
+	re, err := regexp.Compile(*match)
+	if err != nil {
+		return err
+	}
+
+	filename := flags.Arg(0)
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	dc := webcache.NewDiskCache(c.store, c.journalFile(), 0)
+	defer dc.Close()
+	w := webcache.NewWARCWriter(f, strings.HasSuffix(filename, ".gz"))
+	exported, err := dc.ExportWARC(w, path.Base(filename), func(r *webcache.Response) bool {
+		return re.MatchString(r.URL)
+	})
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("Unable to export to %s: %s", filename, err))
+	}
+	fmt.Printf("Exported %d entries to %s\n", exported, filename)
+	return nil
+}
+
+func (c *cacheDir) importWARC(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	policyName := flags.String("policy", webcache.LRU, "Replacement policy, LRU or LFU")
+	cacheSize := flags.Int("size", 100, "Cache capacity in MB")
+	expirationTime := flags.Int("expiration", 3600, "Time in seconds after which imported entries expire")
+	maxEntries := flags.Int("max-entries", 0, "Maximum number of cached entries, 0 for no limit")
+	err := flags.Parse(args)
+	if err != nil || flags.NArg() == 0 {
+		return errUsage
+	}
+	policy, err := webcache.NewPolicy(*policyName)
+	if err != nil {
+		return err
+	}
+
+	//Load the existing entries so that imports evict them as the proxy would
+	dc := webcache.NewDiskCache(c.store, c.journalFile(), webcache.DefaultJournalLatency)
+	defer dc.Close()
+	wc := webcache.NewWebCache(policy, *cacheSize, *expirationTime, *maxEntries, nil)
+	readChannel := make(chan *webcache.DiskCacheEntry)
+	go dc.Read(readChannel)
+	for entry := range readChannel {
+		wc.Initialize(entry.Key, &webcache.Response{
+			URL:            entry.URL,
+			Body:           entry.Value,
+			ContentType:    entry.ContentType,
+			ExpirationTime: entry.ExpirationTime,
+			StoredTime:     entry.StoredTime,
+		})
+	}
+	index := c.index()
+
+	failed := 0
+	for _, filename := range flags.Args() {
+		f, err := os.Open(filename)
+		if err != nil {
+			log.Println(err)
+			failed++
+			continue
+		}
+		var imported int
+		if strings.HasSuffix(filename, ".har") {
+			imported, err = webcache.ImportHAR(f, wc, dc, index)
+		} else {
+			imported, err = webcache.ImportWARC(f, wc, dc, index)
+		}
+		f.Close()
+		if err != nil {
+			log.Println(fmt.Sprintf("Unable to import %s: %s", filename, err))
+			failed++
+		}
+		fmt.Printf("Imported %d entries from %s\n", imported, filename)
+	}
+	err = index.Close()
+	if err != nil {
+		return err
+	}
+	wc.PrintCapacity()
+	if failed > 0 {
+		return errors.New(fmt.Sprintf("Unable to import %d of %d files", failed, flags.NArg()))
+	}
+	return nil
+}
+
+func shortKey(key string) string {
+	if len(key) > 12 {
+		return key[:12]
+	}
+	return key
+}
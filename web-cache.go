@@ -2,143 +2,457 @@ package main
 
 import (
 	"./webcache"
-	"bytes"
+	"context"
 	"errors"
+	"flag"
 	"fmt"
-	"golang.org/x/net/html"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 var (
-	wc          webcache.Cache
-	dc          *webcache.DiskCache
-	invertedMap *webcache.InvertedIndex
-	client      *http.Client
-	ipPort1     *net.TCPAddr
-	ipPort2     *net.TCPAddr
+	wc            webcache.Cache
+	dc            *webcache.DiskCache
+	invertedMap   *webcache.InvertedIndex
+	harRecorder   *webcache.HARRecorder
+	adminServer   *http.Server
+	prefetchPool  *webcache.PrefetchPool
+	fetches       = webcache.NewFetchGroup() //Prefetches in progress
+
+	//Prefetches are cancelled when shutting down takes too long
+	prefetchContext, cancelPrefetches = context.WithCancel(context.Background())
+	clientContexts sync.Map //Cancels the prefetches of the pages requested on each connection
+	accessLog     *webcache.AccessLog
+	accessLogFile *os.File
+	config        *webcache.Config
+	client        *http.Client
+	ipPort1       *net.TCPAddr
+	ipPort2       *net.TCPAddr
 )
 
 const GET = "GET"
 const CONTENT_TYPE = "Content-Type"
 const HTML_TYPE = "text/html"
-const LRU = "LRU"
-const LFU = "LFU"
 const HTTP_PREFIX = "http://"
 const CUSTOM_URL_PREFIX = "http://name_of_server/"
-const CACHE_ROOT = "cache"
 
-func main() {
-	args := os.Args[1:]
+const USAGE = "Usage: web-cache.go [-config file] [-root dir] [-store flat|segment|bolt] [-journal-latency duration] [-shutdown-timeout duration] [-request-timeout duration] [-prefetch-timeout duration] [-prefetch-detach] [-prefetch-concurrency n] [-prefetch-per-host n] [-prefetch-queue n] [-max-entries n] [-quota kind:pattern=limit]... [-ttl kind:pattern=duration]... [-admin ip:port] [-har file] [-warmup file|url] [-warmup-concurrency n] [-warmup-fill ratio] [-log-level level] [-log-format text|json] [-access-log file] [-access-log-format combined|json] [ip1:port1] [ip2:port2] [replacement_policy] [cache_size] [expiration_time]\n"
 
-	if len(args) != 5 {
-		fmt.Print("Usage: web-cache.go [ip1:port1] [ip2:port2] [replacement_policy] [cache_size] [expiration_time]")
-		return
+// listFlag is a repeatable flag whose values replace those of the
+// configuration file.
+type listFlag struct {
+	values *[]string
+	set    bool
+}
+
+func (l *listFlag) String() string {
+	if l.values == nil {
+		return ""
 	}
+	return fmt.Sprint(*l.values)
+}
 
+func (l *listFlag) Set(value string) error {
+	if !l.set {
+		*l.values = nil
+		l.set = true
+	}
+	*l.values = append(*l.values, value)
+	return nil
+}
+
+func main() {
 	var err error
-	ipPort1, err = getAddress(args[0])
+	config, err = parseConfig(os.Args[1:])
 	if err != nil {
-		log.Fatal(err)
+		fmt.Println(err)
+		fmt.Print(USAGE)
+		return
 	}
-
-	ipPort2, err = getAddress(args[1])
+	err = configureLogging(config.Log)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 
-	replacementPolicy := args[2]
-	cacheSize, err := strconv.ParseUint(args[3], 10, 32)
+	ipPort1, err = getAddress(config.Listen)
 	if err != nil {
-		log.Fatal("Invalid parameter [cache_size]")
-	}
-	expirationTime, err := strconv.Atoi(args[4])
-	if err != nil || expirationTime < 0 {
-		log.Fatalf("Invalid value for [expiration_time]")
+		fatal("Invalid parameter [ip1:port1]", err)
 	}
 
-	var policy webcache.Policy
-	switch replacementPolicy {
-	case LRU:
-		policy = webcache.NewLRUPolicy()
-	case LFU:
-		policy = webcache.NewLFUPolicy()
-	default:
-		err = errors.New(fmt.Sprintf("Invalid cache replacement policy [%s]", replacementPolicy))
+	ipPort2, err = getAddress(config.RewriteAddress)
+	if err != nil {
+		fatal("Invalid parameter [ip2:port2]", err)
 	}
 
+	policy, err := webcache.NewPolicy(config.Policy)
 	if err != nil {
-		log.Fatal(err)
+		fatal("Invalid parameter [replacement_policy]", err)
 	}
+	quotas, _ := config.ParsedQuotas()
+	ttlRules, _ := config.TTLRules()
 
-	initializeDiskCache()
-	initializeMMap()
-	initializeWebCache(policy, cacheSize, expirationTime)
+	store := initializeDiskCache(config.Store, config.JournalLatency.Duration)
+	initializeMMap(store)
+	initializeWebCache(policy, uint64(config.CacheSize), int(config.Expiration.Seconds()), config.MaxEntries, quotas)
+	wc.SetTTL(config.Expiration.Duration, ttlRules)
 
+	upstream := config.Upstream
 	client = &http.Client{
 		Transport: &http.Transport{
 			DialContext: (&net.Dialer{
 				//LocalAddr: ipPort1,
-				Timeout:   10 * time.Second,
-				KeepAlive: 30 * time.Second,
+				Timeout:   upstream.DialTimeout.Duration,
+				KeepAlive: upstream.KeepAlive.Duration,
 				DualStack: true,
 			}).DialContext,
-			MaxIdleConns: 100,
-			IdleConnTimeout: 90 * time.Second,
-			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConns: upstream.MaxIdleConns,
+			IdleConnTimeout: upstream.IdleConnTimeout.Duration,
+			TLSHandshakeTimeout: upstream.TLSHandshakeTimeout.Duration,
+			ResponseHeaderTimeout: upstream.ResponseHeaderTimeout.Duration,
 		},
 	}
 
-	log.Println("Starting HTTP proxy server")
+	prefetchPool = webcache.NewPrefetchPool(config.Prefetch.Concurrency, config.Prefetch.PerHost, config.Prefetch.Queue)
+
+	err = webcache.RegisterCacheMetrics(wc, dc)
+	if err != nil {
+		fatal("Unable to register the cache metrics", err)
+	}
+	handle := accessLog.Handler(webcache.Instrument(handleHTTP))
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handle(w, r) })
+	if config.HAR != "" {
+		harRecorder, err = webcache.NewHARRecorder(config.HAR, webcache.DefaultHARFlushInterval)
+		if err != nil {
+			fatal("Unable to record the HAR file", err)
+		}
+		handler = harRecorder.Handler(handle)
+	}
+
+	if config.Admin != "" {
+		adminServer = &http.Server{Addr: config.Admin, Handler: webcache.NewAdmin(wc, dc).Handler()}
+		go serveAdmin()
+	}
+
+	if config.Warmup.Source != "" {
+		go warmUp(config.Warmup.Source, config.Warmup.Concurrency, config.Warmup.Fill)
+	}
+
+	go reloadOnHangup(os.Args[1:])
+
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+
+	logger().Info("starting HTTP proxy server", "address", ipPort1.String())
 	server := &http.Server{
-		Addr:    ipPort1.String(),
-		Handler: http.HandlerFunc(handleHTTP),
+		Addr:        ipPort1.String(),
+		Handler:     handler,
+		ConnContext: connContext,
+		ConnState:   connState,
 	}
+	go func() {
+		err := server.ListenAndServe()
+		if err != http.ErrServerClosed {
+			fatal("Proxy server failed", err)
+		}
+	}()
 
-	log.Println("Serving listening...")
-	err = server.ListenAndServe()
+	<-shutdown
+	shutDown(server, store)
+}
+
+// shutDown stops accepting connections and waits for the requests in
+// progress and the resources being cached, up to the shutdown timeout. It
+// then writes the HAR file and closes the mapping file, the journal and the
+// store, so that the next start needs no recovery.
+func shutDown(server *http.Server, store webcache.Store) {
+	logger().Info("shutting down", "timeout", config.ShutdownTimeout.String())
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout.Duration)
+	defer cancel()
+
+	for _, s := range []*http.Server{server, adminServer} {
+		if s == nil {
+			continue
+		}
+		err := s.Shutdown(ctx)
+		if err != nil {
+			logger().Warn("requests still in progress", "address", s.Addr, "error", err)
+		}
+	}
+	prefetched := make(chan struct{})
+	go func() {
+		prefetchPool.Close()
+		close(prefetched)
+	}()
+	select {
+	case <-prefetched:
+	case <-ctx.Done():
+		logger().Warn("cancelling the prefetches in progress")
+		cancelPrefetches()
+		<-prefetched
+	}
+
+	if harRecorder != nil {
+		err := harRecorder.Close()
+		if err != nil {
+			logger().Error("unable to write HAR file", "file", config.HAR, "error", err)
+		}
+	}
+	err := invertedMap.Close()
+	if err != nil {
+		logger().Error("unable to close the mapping file", "error", err)
+	}
+	err = dc.Close()
 	if err != nil {
-		log.Fatal(err)
+		logger().Error("unable to close the journal", "error", err)
 	}
+	err = store.Close()
+	if err != nil {
+		logger().Error("unable to close the store", "error", err)
+	}
+	if accessLogFile != nil && accessLogFile != os.Stdout {
+		accessLogFile.Close()
+	}
+	logger().Info("shutdown complete")
+}
 
+// parseConfig reads the configuration file given with -config, if any, and
+// overrides its settings with the other flags and the positional arguments.
+func parseConfig(args []string) (*webcache.Config, error) {
+	var configFile string
+	c := webcache.DefaultConfig()
+	flags := configFlags(c, &configFile)
+	flags.Parse(args)
+	if configFile != "" {
+		c = webcache.DefaultConfig()
+		err := webcache.LoadConfig(configFile, c)
+		if err != nil {
+			return nil, err
+		}
+		flags = configFlags(c, &configFile)
+		flags.Parse(args)
+	}
+
+	positional := flags.Args()
+	if len(positional) == 5 {
+		c.Listen = positional[0]
+		c.RewriteAddress = positional[1]
+		c.Policy = positional[2]
+		cacheSize, err := strconv.ParseUint(positional[3], 10, 32)
+		if err != nil {
+			return nil, errors.New("Invalid parameter [cache_size]")
+		}
+		c.CacheSize = int(cacheSize)
+		expirationTime, err := strconv.Atoi(positional[4])
+		if err != nil || expirationTime < 0 {
+			return nil, errors.New("Invalid value for [expiration_time]")
+		}
+		c.Expiration.Duration = time.Duration(expirationTime) * time.Second
+	} else if len(positional) != 0 {
+		return nil, errors.New("Expected all five arguments or none")
+	}
+	return c, c.Validate()
+}
+
+func configFlags(c *webcache.Config, configFile *string) *flag.FlagSet {
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), USAGE)
+		flags.PrintDefaults()
+	}
+	flags.StringVar(configFile, "config", "", "Read the settings from this JSON `file`; flags and arguments override it")
+	flags.StringVar(&c.CacheRoot, "root", c.CacheRoot, "Directory holding the disk cache")
+	flags.IntVar(&c.MaxEntries, "max-entries", c.MaxEntries, "Maximum number of cached entries, 0 for no limit")
+	flags.DurationVar(&c.JournalLatency.Duration, "journal-latency", c.JournalLatency.Duration, "Maximum time the journal waits to group commit records before syncing them to disk")
+	flags.StringVar(&c.Store, "store", c.Store, "Disk cache storage backend, flat (one file per entry), segment (log-structured segment files) or bolt (embedded bbolt database)")
+	flags.DurationVar(&c.ShutdownTimeout.Duration, "shutdown-timeout", c.ShutdownTimeout.Duration, "Maximum time to wait for requests in progress when shutting down")
+	flags.DurationVar(&c.Upstream.RequestTimeout.Duration, "request-timeout", c.Upstream.RequestTimeout.Duration, "Maximum time to fetch a page from its origin server, 0 for no limit")
+	flags.DurationVar(&c.Prefetch.Timeout.Duration, "prefetch-timeout", c.Prefetch.Timeout.Duration, "Maximum time to prefetch a resource embedded in a page, 0 for no limit")
+	flags.BoolVar(&c.Prefetch.Detach, "prefetch-detach", c.Prefetch.Detach, "Keep prefetching and caching the resources of a page after its client went away")
+	flags.IntVar(&c.Prefetch.Concurrency, "prefetch-concurrency", c.Prefetch.Concurrency, "Number of resources prefetched at once")
+	flags.IntVar(&c.Prefetch.PerHost, "prefetch-per-host", c.Prefetch.PerHost, "Number of resources prefetched at once from the same host, 0 for no limit")
+	flags.IntVar(&c.Prefetch.Queue, "prefetch-queue", c.Prefetch.Queue, "Number of resources waiting to be prefetched beyond which prefetches are skipped, 0 for no limit")
+	flags.StringVar(&c.Admin, "admin", c.Admin, "Serve the admin API and Prometheus metrics on this `ip:port`")
+	flags.StringVar(&c.HAR, "har", c.HAR, "Record the proxied traffic to this HAR file")
+	flags.StringVar(&c.Warmup.Source, "warmup", c.Warmup.Source, "Warm up the cache from a file or URL listing URLs one per line, or a sitemap")
+	flags.IntVar(&c.Warmup.Concurrency, "warmup-concurrency", c.Warmup.Concurrency, "Maximum number of warm-up requests in flight")
+	flags.Float64Var(&c.Warmup.Fill, "warmup-fill", c.Warmup.Fill, "Stop warming up once this fraction of the cache is full")
+	flags.StringVar(&c.Log.Level, "log-level", c.Log.Level, "Minimum level of the logged records, debug, info, warn or error")
+	flags.StringVar(&c.Log.Format, "log-format", c.Log.Format, "Log format, text or json")
+	flags.StringVar(&c.Log.AccessLog, "access-log", c.Log.AccessLog, "Write an access log to this file, - for stdout")
+	flags.StringVar(&c.Log.AccessLogFormat, "access-log-format", c.Log.AccessLogFormat, "Access log format, combined or json")
+	flags.Var(&listFlag{values: &c.Quotas}, "quota", "Capacity quota `kind:pattern=limit` (kind is host, suffix or type), e.g. type:video/*=30%. May be repeated.")
+	flags.Var(&listFlag{values: &c.TTL}, "ttl", "Expiration time `kind:pattern=duration` of a partition of the cache, e.g. type:image/*=24h. May be repeated.")
+	return flags
+}
+
+// reloadOnHangup rereads the configuration on SIGHUP and applies the
+// settings that can change while the proxy runs: the expiration time, TTL
+// rules, quotas and logging.
+func reloadOnHangup(args []string) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		reloaded, err := parseConfig(args)
+		if err != nil {
+			logger().Error("unable to reload the configuration", "error", err)
+			continue
+		}
+		err = configureLogging(reloaded.Log)
+		if err != nil {
+			logger().Error("unable to reload the logging configuration", "error", err)
+			continue
+		}
+		quotas, _ := reloaded.ParsedQuotas()
+		ttlRules, _ := reloaded.TTLRules()
+		wc.SetTTL(reloaded.Expiration.Duration, ttlRules)
+		wc.SetQuotas(quotas)
+		logger().Info("configuration reloaded")
+		if changed := config.RestartRequired(reloaded); len(changed) > 0 {
+			logger().Warn("restart the proxy to apply the changed settings", "settings", changed)
+		}
+	}
 }
 
-func initializeDiskCache() {
-	dc = webcache.NewDiskCache(CACHE_ROOT+"/diskcache", CACHE_ROOT+"/journal.log")
+func initializeDiskCache(storeType string, journalLatency time.Duration) webcache.Store {
+	store, err := webcache.OpenStore(storeType, config.CacheRoot)
+	if err != nil {
+		fatal("Unable to open the disk cache", err)
+	}
+	dc = webcache.NewDiskCache(store, config.CacheRoot+"/"+webcache.JournalFilename, journalLatency)
+	return store
 }
 
-func initializeMMap() {
+func initializeMMap(store webcache.Store) {
 
-	invertedMap = &webcache.InvertedIndex{CACHE_ROOT+"/mmap", make(chan webcache.MappingRequest), make(chan webcache.Mapping)}
+	invertedMap = &webcache.InvertedIndex{Filename: config.CacheRoot+"/"+webcache.MappingFilename, Requests: make(chan webcache.MappingRequest), NewMapping: make(chan webcache.Mapping)}
+	if mappings, ok := store.(webcache.MappingStore); ok {
+		invertedMap.Mappings = mappings
+	}
+	invertedMap.Live = func(hashed string) bool { return wc.Contains(hashed) }
+	invertedMap.CheckpointInterval = webcache.DefaultCheckpointInterval
 	loaded := make(chan struct{})
 	go invertedMap.Run(loaded)
 	<- loaded
 }
 
-func initializeWebCache(policy webcache.Policy, cacheSize uint64, expirationTime int) {
-	wc = webcache.NewWebCache(policy, int(cacheSize), expirationTime)
+func initializeWebCache(policy webcache.Policy, cacheSize uint64, expirationTime int, maxEntries int, quotas []webcache.Quota) {
+	wc = webcache.NewWebCache(policy, int(cacheSize), expirationTime, maxEntries, quotas)
 
 	readChannel := make(chan *webcache.DiskCacheEntry)
 	go dc.Read(readChannel)
 	for entry := range readChannel {
 		response := &webcache.Response {
+			URL:            entry.URL,
 			Body:           entry.Value,
 			ContentType:    entry.ContentType,
 			ExpirationTime: entry.ExpirationTime,
+			StoredTime:     entry.StoredTime,
 		}
 		wc.Initialize(entry.Key, response)
 	}
 	wc.PrintCapacity()
 }
 
-func handleHTTP(w http.ResponseWriter, r *http.Request) {
+// configureLogging sets up the logger of the proxy and of the webcache
+// package, and the access log.
+func configureLogging(c webcache.LogConfig) error {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(c.Level))
+	if err != nil {
+		return err
+	}
+	l, err := webcache.NewLogger(os.Stderr, c.Format, level)
+	if err != nil {
+		return err
+	}
+
+	var file *os.File
+	switch c.AccessLog {
+	case "":
+	case "-":
+		file = os.Stdout
+	default:
+		file, err = os.OpenFile(c.AccessLog, os.O_CREATE | os.O_APPEND | os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	if accessLog == nil {
+		accessLog = &webcache.AccessLog{}
+	}
+	var w io.Writer
+	if file != nil {
+		w = file
+	}
+	err = accessLog.Reset(w, c.AccessLogFormat)
+	if err != nil {
+		if file != nil && file != os.Stdout {
+			file.Close()
+		}
+		return err
+	}
+	//Reopening the access log on reload lets it be rotated
+	if accessLogFile != nil && accessLogFile != os.Stdout {
+		accessLogFile.Close()
+	}
+	accessLogFile = file
+
+	webcache.SetLogger(l)
+	slog.SetDefault(l)
+	return nil
+}
+
+func logger() *slog.Logger {
+	return webcache.Log(webcache.ProxyComponent)
+}
+
+func fatal(msg string, err error) {
+	logger().Error(msg, "error", err)
+	os.Exit(1)
+}
+
+func serveAdmin() {
+	logger().Info("serving the admin API", "address", adminServer.Addr)
+	err := adminServer.ListenAndServe()
+	if err != http.ErrServerClosed {
+		fatal("Admin server failed", err)
+	}
+}
+
+// warmUp requests the URLs listed by source through handleGet, as if a client
+// had browsed them, until the cache is fillRatio full.
+func warmUp(source string, concurrency int, fillRatio float64) {
+	warmer := &webcache.Warmer{
+		Handler:     http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handleGet(w, r) }),
+		Client:      client,
+		Stats:       wc.Stats,
+		Concurrency: concurrency,
+		FillRatio:   fillRatio,
+	}
+	urls, err := warmer.Load(source)
+	if err != nil {
+		logger().Error("unable to load warm-up URLs", "source", source, "error", err)
+		return
+	}
+	logger().Info("warming up the cache", "source", source, "urls", len(urls))
+	report := warmer.Run(urls)
+	logger().Info("warm-up finished", "requested", report.Requested, "failed", len(report.Failed), "skipped", report.Skipped)
+}
+
+// handleHTTP serves r and returns its cache status, or "" if it was not
+// cacheable.
+func handleHTTP(w http.ResponseWriter, r *http.Request) string {
 	//TODO: remove this check later
 	//if r.URL.String() == "http://detectportal.firefox.com/success.txt" {
 	//	handleDefault(w, r)
@@ -146,15 +460,16 @@ func handleHTTP(w http.ResponseWriter, r *http.Request) {
 	//}
 	switch r.Method {
 	case GET:
-		handleGet(w, r)
+		return handleGet(w, r)
 	default:
 		//just pass on
 		handleDefault(w, r)
+		return ""
 	}
 }
 
-func handleGet(w http.ResponseWriter, r *http.Request) {
-	log.Println(fmt.Sprintf("GET Request - %s", r.URL.String()))
+func handleGet(w http.ResponseWriter, r *http.Request) string {
+	logger().Debug("GET request", "url", r.URL.String())
 	url := removeCustomPrefix(r.URL.String())
 
 	if _, ok := invertedMap.Get(webcache.Hash(url)); ok { url = webcache.Hash(url) } //get hashshed url if it exists on disk
@@ -165,219 +480,270 @@ func handleGet(w http.ResponseWriter, r *http.Request) {
 	response, err := wc.Get(url)
 	var body []byte
 	var contentType string
+	code := http.StatusOK
+	cacheStatus := webcache.CacheMiss
+	status := &webcache.CacheStatusField{Fwd: webcache.FwdURIMiss, Key: webcache.RemoveHTTPPrefix(url)}
 	if err != nil {
-		log.Println(err.Error())
-		log.Println(fmt.Sprintf("Requesting %s from server", url))
-
+		logger().Debug("cache miss", "url", url, "error", err)
+		if miss, ok := err.(*webcache.MissError); ok && miss.Expired {
+			cacheStatus = webcache.CacheExpired
+			status.Fwd = webcache.FwdStale
+		}
 		mappedURL, ok := invertedMap.Get(url)
 		if ok {
-			log.Printf("Proxied GET for %s resolved to %s", url, mappedURL)
+			logger().Debug("resolved mapped URL", "url", url, "mapped", mappedURL)
 			url = mappedURL
 		}
+		status.Key = webcache.Hash(url)
 
-		resp, err := client.Get(url)
-		if err != nil {
-			log.Println(err)
-			http.Error(w, err.Error(), http.StatusServiceUnavailable)
-			return
-		}
-
-		if strings.HasPrefix(resp.Header.Get(CONTENT_TYPE), HTML_TYPE) {
+		ctx, cancel := withTimeout(r.Context(), config.Upstream.RequestTimeout.Duration)
+		defer cancel()
 
-			body, err = ReplaceURLs(resp.Body)
+		//Requests for url made meanwhile, and its prefetch, share the fetch
+		fetchResponse := func() (*webcache.Response, error) {
+			start := time.Now()
+			logger().Debug("requesting from server", "url", url)
+			resp, err := fetch(ctx, url)
 			if err != nil {
-				log.Println(err)
-				http.Error(w, err.Error(), http.StatusServiceUnavailable) //TODO should probably be different here too
-				return
+				logFetchError(ctx, "request failed", url, err)
+				return nil, err
 			}
-		} else {
-			body, err = ioutil.ReadAll(resp.Body)
-			if err != nil {
-				log.Println(err)
-				http.Error(w, err.Error(), http.StatusServiceUnavailable) //TODO should probably be different here too
-				return
+			defer resp.Body.Close()
+			webcache.ObserveUpstream(start)
+
+			var body []byte
+			contentType := resp.Header.Get(CONTENT_TYPE)
+			if strings.HasPrefix(contentType, HTML_TYPE) {
+				body, err = ReplaceURLs(prefetchContextOf(r), url, resp.Body)
+				if err != nil {
+					logFetchError(ctx, "unable to rewrite page", url, err)
+					return nil, err
+				}
+			} else {
+				body, err = ioutil.ReadAll(resp.Body)
+				if err != nil {
+					logFetchError(ctx, "unable to read response", url, err)
+					return nil, err
+				}
+			}
+			//Only successful responses are cached, as they are served as 200 OK
+			if resp.StatusCode == http.StatusOK {
+				invertedMap.NewMapping <- webcache.Mapping{Original: url, Hashed: webcache.Hash(strings.TrimPrefix(url, HTTP_PREFIX))}
+				status.Stored = enterInCache(url, body, contentType)
 			}
+			return &webcache.Response{URL: url, Body: body, ContentType: contentType, StatusCode: resp.StatusCode}, nil
 		}
-		contentType = resp.Header.Get(CONTENT_TYPE)
-		invertedMap.NewMapping <- webcache.Mapping{Original: url, Hashed: webcache.Hash(strings.TrimPrefix(url, HTTP_PREFIX))}
-		enterInCache(url, body, contentType, make(chan bool))
-		resp.Body.Close()
+		fetched, shared, err := fetches.Do(ctx, url, fetchResponse)
+		if shared && err != nil && ctx.Err() == nil {
+			//The request that was fetching url went away, fetch it again
+			fetched, shared, err = fetches.Do(ctx, url, fetchResponse)
+		}
+		if err != nil {
+			status.SetHeaders(w.Header())
+			http.Error(w, err.Error(), http.StatusServiceUnavailable) //TODO should probably be different here too
+			return cacheStatus
+		}
+		if shared {
+			logger().Debug("attached to fetch in progress", "url", url)
+			status.Collapsed = true
+			_, status.Stored = wc.Rank(status.Key)
+		}
+		code = fetched.StatusCode
+		body = fetched.Body
+		contentType = fetched.ContentType
+		status.TTL = wc.TTL(url, contentType)
 	} else {
-		log.Printf("HIT - %s", r.URL.String())
+		logger().Debug("cache hit", "url", r.URL.String())
+		cacheStatus = webcache.CacheHit
 		body = response.Body
 		contentType = response.ContentType
+		status.Hit = true
+		status.TTL = time.Until(response.ExpirationTime)
+		if !response.StoredTime.IsZero() {
+			status.Age = time.Since(response.StoredTime)
+		}
 	}
+	writeResponse(w, r, status, code, contentType, body)
+	return cacheStatus
+}
+
+func writeResponse(w http.ResponseWriter, r *http.Request, status *webcache.CacheStatusField, code int, contentType string, body []byte) {
+	status.SetHeaders(w.Header())
+	webcache.SetDebugHeaders(w.Header(), r, wc, status.Key)
 	w.Header().Set(CONTENT_TYPE, contentType)
+	w.WriteHeader(code)
 	w.Write(body)
 }
 
-func ReplaceURLs(body io.ReadCloser) ([]byte, error) {
-	doneChannel := make(chan bool)
-	resourceChannel := make(chan string)
-
-	//Goroutine that will begin to fetch resources as we write them to the resource channel
-	//When all resources are fetched, the done channel will be closed
-	go getAllResources(resourceChannel, doneChannel)
-
-	doc, err := html.Parse(body)
-	if err != nil {
-		return nil, errors.New("problem parsing html")
-	}
-	var f func(*html.Node) error
-	f = func(n *html.Node) error {
-		if n.Type == html.ElementNode && (n.Data == "img" || n.Data == "script") {
-			for i, a := range n.Attr {
-				if a.Key == "src" {
-					src := a.Val
-
-					//Only rewrite if it is an absolute link
-					if strings.HasPrefix(src, HTTP_PREFIX) {
-						//Send the resource to the channel so it will be fetched
-						resourceChannel <- src
-						//log.Println("Parsed link: ", n.Data, src)
-						n.Attr[i].Val = createURL(src) //ipPort2.String() + strings.TrimPrefix(src, HTTP_PREFIX)
-					}
-					break
-				}
-			}
-		} else if n.Type == html.ElementNode && n.Data == "link" {
-			for i, a := range n.Attr {
-				if a.Key == "href" {
-					href := a.Val
-
-					//Only rewrite if it is an absolute link
-					if strings.HasPrefix(href, HTTP_PREFIX) {
-						//Send the resource to the channel so it will be fetched
-						resourceChannel <- href
-						//log.Println("Parsed link: ", href)
-						n.Attr[i].Val = createURL(href) //ipPort2.String() + strings.TrimPrefix(href, HTTP_PREFIX)
-					}
-					break
-				}
-			}
-		}
-		for c := n.FirstChild; c != nil; c = c.NextSibling {
-			err = f(c)
-			if err != nil {
-				return err
-			}
-		}
-		return nil
-	}
-	err = f(doc)
+// fetch requests url from its origin server until ctx is done.
+func fetch(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, GET, url, nil)
 	if err != nil {
 		return nil, err
 	}
-
-	//Close the resource channel after parsing is finished
-	close(resourceChannel)
-
-	//Wait for all the resources to be fetched before returning
-	<- doneChannel
-	var buf bytes.Buffer
-	w := io.Writer(&buf)
-	html.Render(w, doc)
-	return buf.Bytes(), nil
+	return client.Do(req)
 }
 
-func getAllResources(resources chan string, done chan bool) {
-	defer close(done)
+// withTimeout returns ctx with a deadline timeout from now, or ctx itself
+// if timeout is 0.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
 
-	//Start fetching each resource
-	var resourcesFetched []chan bool
-	for resource := range resources {
-		doneChannel := make(chan bool)
-		resourcesFetched = append(resourcesFetched, doneChannel)
-		go getResource(resource, doneChannel)
+// logFetchError logs a failed fetch, at debug level if the client went away.
+func logFetchError(ctx context.Context, msg string, url string, err error) {
+	if ctx.Err() == context.Canceled {
+		logger().Debug(msg, "url", url, "error", err)
+	} else {
+		logger().Error(msg, "url", url, "error", err)
 	}
+}
 
-	//Wait for all resources to be fetched
-	for _, resourceFetched := range resourcesFetched {
-		<- resourceFetched
+// ReplaceURLs rewrites the URLs of the resources embedded in the HTML page
+// at pageURL to the proxy and queues them to be prefetched until ctx is
+// done. It returns the rewritten page without waiting for the prefetches.
+func ReplaceURLs(ctx context.Context, pageURL string, body io.ReadCloser) ([]byte, error) {
+	return webcache.RewriteHTML(pageURL, body, func(embedded webcache.EmbeddedURL) (string, bool) {
+		if !webcache.ShouldRewrite(config.Rewrite, embedded.URL) {
+			return "", false
+		}
+		//Documents are rewritten when the client requests them
+		if !embedded.Document {
+			prefetch(ctx, embedded.URL, embedded.Priority)
+		}
+		return createURL(embedded.URL), true
+	})
+}
+
+// prefetch queues url to be prefetched on the prefetch pool until ctx is
+// done. Prefetches outlive the request of their page, whose client requests
+// the resource next.
+func prefetch(ctx context.Context, url string, priority webcache.PrefetchPriority) {
+	if !prefetchPool.Submit(url, priority, func() { getResource(ctx, url) }) {
+		//The client fetches the resource through the proxy instead
+		logger().Debug("prefetch queue full", "url", url)
 	}
 }
 
-func getResource(url string, done chan bool) error {
-	trimmed := removeCustomPrefix(url)
-	_, err := wc.Get(trimmed)
-	if err != nil {
-		//log.Println(err.Error())
-		log.Println(fmt.Sprintf("Requesting resource %s from server", url))
+// getResource fetches and caches url unless it is cached already. It runs
+// once the prefetch is dequeued, so it attaches to a fetch of url started by
+// a client meanwhile, and requests for url made during the prefetch attach
+// to it, instead of fetching it again.
+func getResource(ctx context.Context, url string) error {
+	if ctx.Err() != nil {
+		//The client of the page went away while the prefetch was queued
+		observePrefetchError(ctx)
+		return ctx.Err()
+	}
+	_, err := wc.Get(webcache.Hash(url))
+	if err == nil {
+		webcache.ObservePrefetch(webcache.PrefetchCached)
+		return nil
+	}
+	ctx, cancel := withTimeout(ctx, config.Prefetch.Timeout.Duration)
+	defer cancel()
 
-		resp, err := client.Get(url)
+	_, shared, err := fetches.Do(ctx, url, func() (*webcache.Response, error) {
+		logger().Debug("requesting resource from server", "url", url)
+		start := time.Now()
+		resp, err := fetch(ctx, url)
 		if err != nil {
-			log.Println(err.Error())
-			return err
+			logFetchError(ctx, "resource request failed", url, err)
+			observePrefetchError(ctx)
+			return nil, err
 		}
+		webcache.ObserveUpstream(start)
 		defer resp.Body.Close()
 		//log.Println(fmt.Sprintf("Successfully requested resource %s", url))
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			return err
+			logFetchError(ctx, "unable to read resource", url, err)
+			observePrefetchError(ctx)
+			return nil, err
 		}
 		contentType := resp.Header.Get(CONTENT_TYPE)
-
-		//Start a goroutine that will save the response to disk/cache
-		go enterInCache(trimmed, body, contentType, done)
-		return nil
+		if resp.StatusCode == http.StatusOK {
+			webcache.ObservePrefetch(webcache.PrefetchFetched)
+			enterInCache(url, body, contentType)
+		} else {
+			//Requests attached to the prefetch still get the response
+			logger().Debug("resource not cached", "url", url, "status", resp.StatusCode)
+			webcache.ObservePrefetch(webcache.PrefetchFailed)
+		}
+		return &webcache.Response{URL: url, Body: body, ContentType: contentType, StatusCode: resp.StatusCode}, nil
+	})
+	if shared && err == nil {
+		webcache.ObservePrefetch(webcache.PrefetchCached)
 	}
-	return nil
+	return err
 }
 
-func enterInCache(url string, body webcache.Value, contentType string, done chan bool) {
-	defer close(done)
+// clientContextKey is the key of the context cancelled when the connection
+// of a request is closed.
+type clientContextKey struct{}
 
-	//Find out what needs to be deleted
-	toDelete, shouldCache := wc.FindEvictionEntries(url, body)
+// connContext adds to the context of the requests made on c a context,
+// derived from prefetchContext, that is cancelled when c is closed.
+func connContext(ctx context.Context, c net.Conn) context.Context {
+	client, cancel := context.WithCancel(prefetchContext)
+	clientContexts.Store(c, cancel)
+	return context.WithValue(ctx, clientContextKey{}, client)
+}
+
+// connState cancels the client context of c once c is closed, the client
+// having gone away.
+func connState(c net.Conn, state http.ConnState) {
+	if state != http.StateClosed && state != http.StateHijacked {
+		return
+	}
+	if cancel, ok := clientContexts.LoadAndDelete(c); ok {
+		cancel.(context.CancelFunc)()
+	}
+}
 
-	//Delete from disk
-	waitChannels := make(map[string]chan error)
-	for _, elem := range toDelete {
-		waitChannel := make(chan error)
-		waitChannels[elem] = waitChannel
-		dc.DeleteChannel <- &webcache.DiskCacheEntry{Key: elem, DoneChannel: waitChannel}
+// prefetchContextOf returns the context of the prefetches of the page
+// requested by r. They are cancelled when the client of r goes away, unless
+// prefetches are detached, and when shutting down takes too long.
+func prefetchContextOf(r *http.Request) context.Context {
+	if config.Prefetch.Detach {
+		return prefetchContext
+	}
+	if client, ok := r.Context().Value(clientContextKey{}).(context.Context); ok {
+		return client
 	}
+	return prefetchContext
+}
 
-	//Delete from web cache
-	for key, waitChannel := range waitChannels {
-		<-waitChannel
-		wc.Delete(key)
+func observePrefetchError(ctx context.Context) {
+	if ctx.Err() == context.Canceled {
+		webcache.ObservePrefetch(webcache.PrefetchCancelled)
+	} else {
+		webcache.ObservePrefetch(webcache.PrefetchFailed)
 	}
+}
 
-	if shouldCache {
-		//Save entry to disk
-		saveChannel := make(chan error)
-		expiration := time.Now().Add(wc.ExpirationTime())
-		dc.SaveChannel <- &webcache.DiskCacheEntry{
-			Key:            webcache.Hash(url),
-			Value:          body,
-			ContentType:    contentType,
-			ExpirationTime: expiration,
-			DoneChannel:    saveChannel,
-		}
-		err := <-saveChannel
-
-		//Save entry to web cache
-		if err == nil {
-			//Only save to web cache if save to disk was successful
-			response := &webcache.Response{
-				Body:           body,
-				ContentType:    contentType,
-				ExpirationTime: expiration,
-			}
-			wc.Set(url, response)
-		} else {
-			log.Println(fmt.Sprintf("Error saving %s to disk", url))
-		}
+// enterInCache caches body for url and reports whether it was cached.
+func enterInCache(url string, body webcache.Value, contentType string) bool {
+	cached, err := webcache.Admit(wc, dc, url, body, contentType)
+	if err != nil {
+		logger().Error("unable to save to disk", "url", url, "error", err)
 	}
+	return cached
 }
 
 func handleDefault(w http.ResponseWriter, r *http.Request) {
-	resp, err := http.DefaultTransport.RoundTrip(r)
+	ctx, cancel := withTimeout(r.Context(), config.Upstream.RequestTimeout.Duration)
+	defer cancel()
+	start := time.Now()
+	resp, err := http.DefaultTransport.RoundTrip(r.WithContext(ctx))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
+	webcache.ObserveUpstream(start)
 	defer resp.Body.Close()
 	copyHeader(w.Header(), resp.Header)
 	w.WriteHeader(resp.StatusCode)
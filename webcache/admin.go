@@ -0,0 +1,161 @@
+package webcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Admin serves a JSON API to inspect and purge a running cache:
+//
+//	GET  /stats                    capacity and entry counts
+//	GET  /entries                  every cached entry
+//	GET  /entry?url=U              the entry cached for URL U
+//	POST /purge?url=U|host=H|regex=R  delete the matching entries
+//	POST /flush                    delete every entry
+//	GET  /metrics                  Prometheus metrics
+//
+// Entries are deleted from disk, journaling the deletion, and then from
+// the web cache, as evictions are.
+type Admin struct {
+	Cache Cache
+	Disk  *DiskCache
+}
+
+func NewAdmin(wc Cache, dc *DiskCache) *Admin {
+	return &Admin{Cache: wc, Disk: dc}
+}
+
+func (a *Admin) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", a.handleStats)
+	mux.HandleFunc("/entries", a.handleEntries)
+	mux.HandleFunc("/entry", a.handleEntry)
+	mux.HandleFunc("/purge", a.handlePurge)
+	mux.HandleFunc("/flush", a.handleFlush)
+	mux.Handle("/metrics", MetricsHandler())
+	return mux
+}
+
+type purgeResult struct {
+	Purged int      `json:"purged"`
+	Keys   []string `json:"keys"`
+}
+
+func (a *Admin) handleStats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, a.Cache.Stats())
+}
+
+func (a *Admin) handleEntries(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	entries := a.Cache.Entries()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].URL < entries[j].URL })
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (a *Admin) handleEntry(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	url := r.URL.Query().Get("url")
+	if url == "" {
+		writeError(w, http.StatusBadRequest, "Missing url parameter")
+		return
+	}
+	key := Hash(url)
+	for _, entry := range a.Cache.Entries() {
+		if entry.Key == key {
+			writeJSON(w, http.StatusOK, entry)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, fmt.Sprintf("%s is not cached", url))
+}
+
+func (a *Admin) handlePurge(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	query := r.URL.Query()
+	var match func(entry EntryInfo) bool
+	switch {
+	case len(query) != 1:
+		writeError(w, http.StatusBadRequest, "Expected exactly one of the url, host or regex parameters")
+		return
+	case query.Get("url") != "":
+		key := Hash(query.Get("url"))
+		match = func(entry EntryInfo) bool { return entry.Key == key }
+	case query.Get("host") != "":
+		host := strings.ToLower(query.Get("host"))
+		match = func(entry EntryInfo) bool { return HostOf(entry.URL) == host }
+	case query.Get("regex") != "":
+		re, err := regexp.Compile(query.Get("regex"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		match = func(entry EntryInfo) bool { return re.MatchString(entry.URL) }
+	default:
+		writeError(w, http.StatusBadRequest, "Expected exactly one of the url, host or regex parameters")
+		return
+	}
+	a.purge(w, match)
+}
+
+func (a *Admin) handleFlush(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	a.purge(w, func(entry EntryInfo) bool { return true })
+}
+
+func (a *Admin) purge(w http.ResponseWriter, match func(entry EntryInfo) bool) {
+	result := purgeResult{Keys: []string{}}
+	for _, entry := range a.Cache.Entries() {
+		if !match(entry) {
+			continue
+		}
+		err := a.Disk.Remove(entry.Key)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("Unable to delete %s from disk: %s", entry.Key, err))
+			return
+		}
+		a.Cache.Delete(entry.Key)
+		Log(AdminComponent).Info("purge", "url", entry.URL, "key", entry.Key)
+		result.Purged++
+		result.Keys = append(result.Keys, entry.Key)
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("Method %s not allowed", r.Method))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(v)
+	if err != nil {
+		Log(AdminComponent).Error("unable to write response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,107 @@
+package webcache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func newTestAdmin(t *testing.T, urls ...string) (*Admin, *MemoryStore, func()) {
+	dir, _ := ioutil.TempDir("", "admin")
+	store := NewMemoryStore()
+	dc := NewDiskCache(store, path.Join(dir, "journal.log"), 0)
+	wc := NewWebCache(NewLRUPolicy(), 1, 60, 0, nil)
+	for _, url := range urls {
+		_, err := Admit(wc, dc, url, Value(url), "text/plain")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return NewAdmin(wc, dc), store, func() { os.RemoveAll(dir) }
+}
+
+func adminRequest(t *testing.T, admin *Admin, method string, target string, v interface{}) int {
+	w := httptest.NewRecorder()
+	admin.Handler().ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	if v != nil {
+		err := json.Unmarshal(w.Body.Bytes(), v)
+		if err != nil {
+			t.Fatalf("Invalid JSON from %s %s: %s", method, target, err)
+		}
+	}
+	return w.Code
+}
+
+func Test_Admin_Inspect(t *testing.T) {
+	admin, _, cleanup := newTestAdmin(t, "http://a.com/1", "http://b.com/1")
+	defer cleanup()
+	admin.Cache.Get(Hash("http://a.com/1"))
+
+	var stats CacheStats
+	adminRequest(t, admin, "GET", "/stats", &stats)
+	if stats.Entries != 2 || stats.MaxCapacity != 1000000 || stats.CurrentCapacity != EntrySize(Value("http://a.com/1"))*2 {
+		t.Errorf("Expected stats of 2 entries, got %+v", stats)
+	}
+
+	var entries []EntryInfo
+	adminRequest(t, admin, "GET", "/entries", &entries)
+	if len(entries) != 2 || entries[0].URL != "http://a.com/1" || entries[0].Hits != 1 || entries[1].Hits != 0 {
+		t.Errorf("Expected 2 entries sorted by URL with their hits, got %+v", entries)
+	}
+
+	var entry EntryInfo
+	if code := adminRequest(t, admin, "GET", "/entry?url=http://b.com/1", &entry); code != http.StatusOK || entry.Key != Hash("http://b.com/1") {
+		t.Errorf("Expected entry for http://b.com/1, got %d %+v", code, entry)
+	}
+	if code := adminRequest(t, admin, "GET", "/entry?url=http://c.com/", nil); code != http.StatusNotFound {
+		t.Errorf("Expected 404 looking up an uncached URL, got %d", code)
+	}
+	if code := adminRequest(t, admin, "GET", "/flush", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected GET /flush to be rejected, got %d", code)
+	}
+}
+
+func Test_Admin_Purge(t *testing.T) {
+	admin, store, cleanup := newTestAdmin(t, "http://a.com/1", "http://a.com/2.png", "http://b.com/1", "http://c.com/1")
+	defer cleanup()
+
+	for _, test := range []struct {
+		target string
+		purged int
+	}{
+		{"/purge?url=http://c.com/1", 1},
+		{"/purge?regex=\\.png$", 1},
+		{"/purge?host=A.com", 1},
+		{"/purge?url=http://c.com/1", 0},
+		{"/flush", 1},
+	} {
+		var result purgeResult
+		code := adminRequest(t, admin, "POST", test.target, &result)
+		if code != http.StatusOK || result.Purged != test.purged {
+			t.Errorf("Expected %s to purge %d entries, got %d %+v", test.target, test.purged, code, result)
+		}
+		for _, key := range result.Keys {
+			if _, err := store.Get(key); err != ErrNotFound {
+				t.Errorf("Expected %s to be deleted from disk", key)
+			}
+		}
+	}
+	if stats := admin.Cache.Stats(); stats.Entries != 0 || stats.CurrentCapacity != 0 {
+		t.Errorf("Expected an empty cache, got %+v", stats)
+	}
+	//Purged entries must not be evicted again to make room
+	Admit(admin.Cache, admin.Disk, "http://d.com/1", make(Value, 600000), "text/plain")
+	if toDelete, ok := admin.Cache.FindEvictionEntries("http://d.com/2", make(Value, 600000), "text/plain"); !ok || len(toDelete) != 1 || toDelete[0] != Hash("http://d.com/1") {
+		t.Errorf("Expected only http://d.com/1 to be evicted, got %v", toDelete)
+	}
+
+	for _, target := range []string{"/purge", "/purge?url=a&host=b", "/purge?regex=("} {
+		if code := adminRequest(t, admin, "POST", target, nil); code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be rejected, got %d", target, code)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package webcache
+
+import (
+	"os"
+	"path"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	entriesBucket  = []byte("entries")
+	mappingsBucket = []byte("mappings")
+)
+
+// BoltStore keeps entries and URL mappings in buckets of an embedded bbolt
+// database. Every write is its own transaction, so entries are never left
+// partially written and neither the journal nor the mapping file is needed.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(filename string) (*BoltStore, error) {
+	err := os.MkdirAll(path.Dir(filename), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filename, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{entriesBucket, mappingsBucket} {
+			_, err := tx.CreateBucketIfNotExists(bucket)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Transactional() {}
+
+func (s *BoltStore) Put(key string, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).Put([]byte(key), value)
+	})
+}
+
+func (s *BoltStore) Get(key string) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(entriesBucket).Get([]byte(key))
+		if v == nil {
+			return ErrNotFound
+		}
+		//Values are only valid for the life of the transaction
+		value = append([]byte(nil), v...)
+		return nil
+	})
+	return value, err
+}
+
+func (s *BoltStore) Delete(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).Delete([]byte(key))
+	})
+}
+
+func (s *BoltStore) Iterate(fn func(key string) error) error {
+	var keys []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err = fn(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltStore) LoadMappings() (map[string]string, error) {
+	mappings := make(map[string]string)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(mappingsBucket).ForEach(func(k, v []byte) error {
+			mappings[string(k)] = string(v)
+			return nil
+		})
+	})
+	return mappings, err
+}
+
+func (s *BoltStore) PutMapping(mapping Mapping) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(mappingsBucket).Put([]byte(mapping.Hashed), []byte(mapping.Original))
+	})
+}
@@ -0,0 +1,53 @@
+package webcache
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func Test_Bolt_DiskCache_Without_Journal(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "bolt")
+	defer os.RemoveAll(dir)
+	store, err := NewBoltStore(path.Join(dir, "cache.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc := NewDiskCache(store, path.Join(dir, "journal.log"), 0)
+
+	url := "http://a.com/1"
+	err = dc.Put(&DiskCacheEntry{Key: Hash(url), URL: url, Value: Value("body"), ExpirationTime: time.Now().Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc.Put(&DiskCacheEntry{Key: Hash("http://a.com/2"), URL: "http://a.com/2", Value: Value("body")})
+	dc.Remove(Hash("http://a.com/2"))
+	store.PutMapping(Mapping{Original: url, Hashed: Hash(url)})
+	store.Close()
+
+	if _, err := os.Stat(path.Join(dir, "journal.log")); !os.IsNotExist(err) {
+		t.Errorf("Expected no journal for a bolt store")
+	}
+
+	store, err = NewBoltStore(path.Join(dir, "cache.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	readChannel := make(chan *DiskCacheEntry)
+	go NewDiskCache(store, "", 0).Read(readChannel)
+	var entries []*DiskCacheEntry
+	for entry := range readChannel {
+		entries = append(entries, entry)
+	}
+	if len(entries) != 1 || entries[0].URL != url || string(entries[0].Value) != "body" {
+		t.Errorf("Expected only the entry for %s, got %d entries", url, len(entries))
+	}
+
+	mappings, err := store.LoadMappings()
+	if err != nil || mappings[Hash(url)] != url {
+		t.Errorf("Expected mapping for %s, got %v (%v)", url, mappings, err)
+	}
+}
@@ -0,0 +1,104 @@
+package webcache
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Response headers describing how the cache handled a request, and the
+// request header asking for the debug headers.
+const (
+	CacheStatusHeader = "Cache-Status"
+	AgeHeader         = "Age"
+	XCacheHeader      = "X-Cache"
+
+	DebugHeader = "X-Webcache-Debug"
+	KeyHeader   = "X-Webcache-Key"
+	RankHeader  = "X-Webcache-Rank"
+
+	//Identifies the cache in Cache-Status
+	CacheName = "webcache"
+)
+
+// Reasons for forwarding a request to the origin server, from RFC 9211.
+const (
+	FwdURIMiss = "uri-miss"
+	FwdStale   = "stale"
+)
+
+// CacheStatusField is the Cache-Status (RFC 9211) of a response. Responses
+// are either hits or forwarded to the origin server for the reason in Fwd,
+// in which case Stored tells whether the cache kept them and Collapsed
+// whether they were shared with a fetch already in progress.
+type CacheStatusField struct {
+	Hit       bool
+	Fwd       string
+	Stored    bool
+	Collapsed bool
+	TTL       time.Duration //Remaining freshness of responses served or stored
+	Age       time.Duration //Time since a response served from the cache was stored
+	Key       string
+}
+
+func (s *CacheStatusField) String() string {
+	params := []string{CacheName}
+	if s.Hit {
+		params = append(params, "hit")
+	} else if s.Fwd != "" {
+		params = append(params, "fwd="+s.Fwd)
+	}
+	if s.Stored {
+		params = append(params, "stored")
+	}
+	if s.Collapsed {
+		params = append(params, "collapsed")
+	}
+	if s.Hit || s.Stored {
+		params = append(params, fmt.Sprintf("ttl=%d", int64(s.TTL/time.Second)))
+	}
+	if s.Key != "" {
+		params = append(params, "key="+strconv.Quote(s.Key))
+	}
+	return strings.Join(params, "; ")
+}
+
+// XCache returns the X-Cache value of the response, HIT, MISS or EXPIRED.
+func (s *CacheStatusField) XCache() string {
+	if s.Hit {
+		return CacheHit
+	}
+	if s.Fwd == FwdStale {
+		return CacheExpired
+	}
+	return CacheMiss
+}
+
+// SetHeaders sets the Cache-Status and X-Cache headers of a response, and
+// its Age if it was served from the cache.
+func (s *CacheStatusField) SetHeaders(h http.Header) {
+	h.Set(CacheStatusHeader, s.String())
+	h.Set(XCacheHeader, s.XCache())
+	if s.Hit {
+		age := int64(s.Age / time.Second)
+		if age < 0 {
+			age = 0
+		}
+		h.Set(AgeHeader, strconv.FormatInt(age, 10))
+	}
+}
+
+// SetDebugHeaders sets the cache key of a response and, if it is cached,
+// the rank of its entry in the replacement policy when r asks for them
+// with the debug header.
+func SetDebugHeaders(h http.Header, r *http.Request, wc Cache, key string) {
+	if r.Header.Get(DebugHeader) == "" {
+		return
+	}
+	h.Set(KeyHeader, key)
+	if rank, ok := wc.Rank(key); ok {
+		h.Set(RankHeader, strconv.Itoa(rank))
+	}
+}
@@ -0,0 +1,55 @@
+package webcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_CacheStatus_Headers(t *testing.T) {
+	for _, test := range []struct {
+		status      CacheStatusField
+		cacheStatus string
+		xCache      string
+		age         string
+	}{
+		{CacheStatusField{Hit: true, TTL: 50 * time.Second, Age: 10 * time.Second, Key: "k"}, `webcache; hit; ttl=50; key="k"`, CacheHit, "10"},
+		{CacheStatusField{Fwd: FwdURIMiss, Stored: true, TTL: 60 * time.Second, Key: "k"}, `webcache; fwd=uri-miss; stored; ttl=60; key="k"`, CacheMiss, ""},
+		{CacheStatusField{Fwd: FwdURIMiss, Stored: true, Collapsed: true, TTL: 60 * time.Second, Key: "k"}, `webcache; fwd=uri-miss; stored; collapsed; ttl=60; key="k"`, CacheMiss, ""},
+		{CacheStatusField{Fwd: FwdStale, Key: "k"}, `webcache; fwd=stale; key="k"`, CacheExpired, ""},
+	} {
+		h := http.Header{}
+		test.status.SetHeaders(h)
+		if h.Get(CacheStatusHeader) != test.cacheStatus {
+			t.Errorf("Expected Cache-Status %s, got %s", test.cacheStatus, h.Get(CacheStatusHeader))
+		}
+		if h.Get(XCacheHeader) != test.xCache {
+			t.Errorf("Expected X-Cache %s, got %s", test.xCache, h.Get(XCacheHeader))
+		}
+		if h.Get(AgeHeader) != test.age {
+			t.Errorf("Expected Age %q, got %q", test.age, h.Get(AgeHeader))
+		}
+	}
+}
+
+func Test_CacheStatus_Debug(t *testing.T) {
+	wc := NewWebCache(NewLRUPolicy(), 1, 60, 0, nil)
+	for _, url := range []string{"http://a.com/1", "http://a.com/2"} {
+		wc.FindEvictionEntries(url, Value(url), "text/plain")
+		wc.Set(url, &Response{URL: url, Body: Value(url)})
+	}
+
+	h := http.Header{}
+	SetDebugHeaders(h, httptest.NewRequest("GET", "http://a.com/1", nil), wc, Hash("http://a.com/1"))
+	if h.Get(KeyHeader) != "" {
+		t.Errorf("Expected no debug headers without %s", DebugHeader)
+	}
+
+	r := httptest.NewRequest("GET", "http://a.com/1", nil)
+	r.Header.Set(DebugHeader, "1")
+	SetDebugHeaders(h, r, wc, Hash("http://a.com/1"))
+	if h.Get(KeyHeader) != Hash("http://a.com/1") || h.Get(RankHeader) != "0" {
+		t.Errorf("Expected key %s with rank 0, got %s with rank %s", Hash("http://a.com/1"), h.Get(KeyHeader), h.Get(RankHeader))
+	}
+}
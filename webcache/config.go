@@ -0,0 +1,240 @@
+package webcache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"time"
+)
+
+const (
+	DefaultShutdownTimeout = 30 * time.Second
+	DefaultPrefetchTimeout = 30 * time.Second
+)
+
+// Config holds the settings of the proxy, read from a JSON configuration
+// file. Durations are written as strings such as "10s" or "1h30m".
+type Config struct {
+	Listen          string        `json:"listen"`         //Address clients connect to
+	RewriteAddress  string        `json:"rewriteAddress"` //Address embedded URLs are rewritten to
+	Policy          string        `json:"policy"`
+	CacheSize       int           `json:"cacheSize"` //In MB, in memory and on disk alike
+	MaxEntries      int           `json:"maxEntries"`
+	Expiration      Duration      `json:"expiration"`
+	TTL             []string      `json:"ttl"`
+	Quotas          []string      `json:"quotas"`
+	CacheRoot       string        `json:"cacheRoot"`
+	Store           string        `json:"store"`
+	JournalLatency  Duration      `json:"journalLatency"`
+	ShutdownTimeout Duration      `json:"shutdownTimeout"`
+	Upstream        Upstream      `json:"upstream"`
+	Rewrite         []RewriteRule `json:"rewrite"`
+	Prefetch        Prefetch      `json:"prefetch"`
+	Admin           string        `json:"admin"`
+	HAR             string        `json:"har"`
+	Warmup          Warmup        `json:"warmup"`
+	Log             LogConfig     `json:"log"`
+}
+
+// Upstream configures the HTTP client fetching from origin servers.
+type Upstream struct {
+	DialTimeout           Duration `json:"dialTimeout"`
+	KeepAlive             Duration `json:"keepAlive"`
+	TLSHandshakeTimeout   Duration `json:"tlsHandshakeTimeout"`
+	ResponseHeaderTimeout Duration `json:"responseHeaderTimeout"` //0 for no timeout
+	IdleConnTimeout       Duration `json:"idleConnTimeout"`
+	MaxIdleConns          int      `json:"maxIdleConns"`
+	RequestTimeout        Duration `json:"requestTimeout"` //0 for no timeout
+}
+
+// Prefetch configures the prefetching of the resources embedded in pages,
+// which runs in the background once the page is returned. Prefetches are
+// cancelled when the client of the page goes away, unless they are detached.
+// They are run by a pool of Concurrency workers, at most PerHost of them
+// against the same host.
+type Prefetch struct {
+	Timeout     Duration `json:"timeout"` //0 for no timeout
+	Detach      bool     `json:"detach"`
+	Concurrency int      `json:"concurrency"`
+	PerHost     int      `json:"perHost"` //0 for no limit
+	Queue       int      `json:"queue"`   //0 for no limit
+}
+
+type Warmup struct {
+	Source      string  `json:"source"`
+	Concurrency int     `json:"concurrency"`
+	Fill        float64 `json:"fill"`
+}
+
+type LogConfig struct {
+	Level           string `json:"level"`
+	Format          string `json:"format"`
+	AccessLog       string `json:"accessLog"`
+	AccessLogFormat string `json:"accessLogFormat"`
+}
+
+// Duration is a time.Duration read from and written to JSON as a string.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid duration %s", b))
+	}
+	d.Duration, err = time.ParseDuration(s)
+	return err
+}
+
+// RewriteRule decides whether the URLs embedded in HTML pages that
+// match a regular expression are rewritten to the proxy and prefetched.
+type RewriteRule struct {
+	Match   string `json:"match"`
+	Rewrite bool   `json:"rewrite"`
+	re      *regexp.Regexp
+}
+
+// ShouldRewrite applies the first of rules matching url. URLs no rule
+// matches are rewritten.
+func ShouldRewrite(rules []RewriteRule, url string) bool {
+	for _, rule := range rules {
+		if rule.re != nil && rule.re.MatchString(url) {
+			return rule.Rewrite
+		}
+	}
+	return true
+}
+
+// DefaultConfig returns the settings used for everything the configuration
+// file and the command line leave out.
+func DefaultConfig() *Config {
+	return &Config{
+		CacheRoot:       "cache",
+		Store:           FlatStoreType,
+		JournalLatency:  Duration{DefaultJournalLatency},
+		ShutdownTimeout: Duration{DefaultShutdownTimeout},
+		Upstream: Upstream{
+			DialTimeout:         Duration{10 * time.Second},
+			KeepAlive:           Duration{30 * time.Second},
+			TLSHandshakeTimeout: Duration{10 * time.Second},
+			IdleConnTimeout:     Duration{90 * time.Second},
+			MaxIdleConns:        100,
+		},
+		Prefetch: Prefetch{
+			Timeout:     Duration{DefaultPrefetchTimeout},
+			Concurrency: DefaultPrefetchConcurrency,
+			PerHost:     DefaultPrefetchPerHost,
+			Queue:       DefaultPrefetchQueue,
+		},
+		Warmup: Warmup{
+			Concurrency: DefaultWarmupConcurrency,
+			Fill:        DefaultWarmupFillRatio,
+		},
+		Log: LogConfig{
+			Level:           "info",
+			Format:          TextFormat,
+			AccessLogFormat: CombinedFormat,
+		},
+	}
+}
+
+// LoadConfig reads the configuration file filename over config, so that
+// settings the file leaves out keep their value.
+func LoadConfig(filename string, config *Config) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	dec := json.NewDecoder(file)
+	dec.DisallowUnknownFields()
+	err = dec.Decode(config)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid configuration file %s: %s", filename, err))
+	}
+	return nil
+}
+
+// Validate checks the settings and compiles the rewrite rules.
+func (c *Config) Validate() error {
+	if c.Listen == "" || c.RewriteAddress == "" || c.Policy == "" || c.CacheSize <= 0 {
+		return errors.New("The listen and rewrite addresses, the replacement policy and the cache size are required")
+	}
+	if c.Expiration.Duration < 0 {
+		return errors.New(fmt.Sprintf("Invalid expiration [%s]", c.Expiration))
+	}
+	if c.Prefetch.Concurrency <= 0 || c.Prefetch.PerHost < 0 || c.Prefetch.Queue < 0 {
+		return errors.New("The prefetch concurrency must be positive and the per host and queue limits may not be negative")
+	}
+	_, err := c.TTLRules()
+	if err != nil {
+		return err
+	}
+	_, err = c.ParsedQuotas()
+	if err != nil {
+		return err
+	}
+	for i := range c.Rewrite {
+		c.Rewrite[i].re, err = regexp.Compile(c.Rewrite[i].Match)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Invalid rewrite rule [%s]: %s", c.Rewrite[i].Match, err))
+		}
+	}
+	return nil
+}
+
+func (c *Config) TTLRules() ([]TTLRule, error) {
+	var rules []TTLRule
+	for _, s := range c.TTL {
+		rule, err := ParseTTLRule(s)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (c *Config) ParsedQuotas() ([]Quota, error) {
+	var quotas []Quota
+	for _, s := range c.Quotas {
+		quota, err := ParseQuota(s)
+		if err != nil {
+			return nil, err
+		}
+		quotas = append(quotas, quota)
+	}
+	return quotas, nil
+}
+
+// RestartRequired returns the settings that differ between c and other
+// and can only be applied by restarting the proxy. Expiration, TTL rules,
+// quotas and logging can be changed while it runs.
+func (c *Config) RestartRequired(other *Config) []string {
+	var changed []string
+	a := reflect.ValueOf(c).Elem()
+	b := reflect.ValueOf(other).Elem()
+	for i := 0; i < a.NumField(); i++ {
+		field := a.Type().Field(i)
+		switch field.Name {
+		case "Expiration", "TTL", "Quotas", "Log":
+			continue
+		}
+		//Compare the settings as written, rewrite rules are compiled
+		before, _ := json.Marshal(a.Field(i).Interface())
+		after, _ := json.Marshal(b.Field(i).Interface())
+		if string(before) != string(after) {
+			changed = append(changed, field.Tag.Get("json"))
+		}
+	}
+	return changed
+}
@@ -0,0 +1,103 @@
+package webcache
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+const testConfig = `{
+	"listen": "127.0.0.1:8080",
+	"rewriteAddress": "127.0.0.1:8080",
+	"policy": "LRU",
+	"cacheSize": 100,
+	"expiration": "5m",
+	"ttl": ["type:image/*=24h"],
+	"upstream": {"dialTimeout": "2s"},
+	"prefetch": {"detach": true},
+	"rewrite": [{"match": "^http://ads\\.", "rewrite": false}]
+}`
+
+func writeConfig(t *testing.T, config string) string {
+	dir, _ := ioutil.TempDir("", "config")
+	filename := path.Join(dir, "webcache.json")
+	ioutil.WriteFile(filename, []byte(config), 0644)
+	return filename
+}
+
+func Test_Config_Load(t *testing.T) {
+	filename := writeConfig(t, testConfig)
+	defer os.RemoveAll(path.Dir(filename))
+
+	config := DefaultConfig()
+	err := LoadConfig(filename, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = config.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Expiration.Duration != 5*time.Minute || config.Upstream.DialTimeout.Duration != 2*time.Second {
+		t.Errorf("Expected the durations of the file, got %s and %s", config.Expiration, config.Upstream.DialTimeout)
+	}
+	if config.Upstream.KeepAlive.Duration != 30*time.Second || config.CacheRoot != "cache" || config.Prefetch.Timeout.Duration != DefaultPrefetchTimeout {
+		t.Errorf("Expected the defaults for settings the file leaves out, got %s, %s and %s", config.Upstream.KeepAlive, config.CacheRoot, config.Prefetch.Timeout)
+	}
+	if !config.Prefetch.Detach {
+		t.Errorf("Expected prefetches to be detached")
+	}
+	if DefaultConfig().Prefetch.Detach {
+		t.Errorf("Expected prefetches to be cancelled with their page by default")
+	}
+	if ShouldRewrite(config.Rewrite, "http://ads.a.com/x.js") || !ShouldRewrite(config.Rewrite, "http://a.com/x.js") {
+		t.Errorf("Expected only URLs of ads hosts to be left alone")
+	}
+}
+
+func Test_Config_Invalid(t *testing.T) {
+	for _, invalid := range []string{
+		`{"listen": "127.0.0.1:8080"}`,
+		`{"listen": "127.0.0.1:8080", "rewriteAddress": "127.0.0.1:8080", "policy": "LRU", "cacheSize": 100, "ttl": ["image=1h"]}`,
+		`{"listen": "127.0.0.1:8080", "rewriteAddress": "127.0.0.1:8080", "policy": "LRU", "cacheSize": 100, "rewrite": [{"match": "("}]}`,
+		`{"listen": "127.0.0.1:8080", "colour": "red"}`,
+		`{"expiration": 300}`,
+	} {
+		filename := writeConfig(t, invalid)
+		config := DefaultConfig()
+		err := LoadConfig(filename, config)
+		if err == nil {
+			err = config.Validate()
+		}
+		if err == nil {
+			t.Errorf("Expected error loading %s", invalid)
+		}
+		os.RemoveAll(path.Dir(filename))
+	}
+}
+
+func Test_Config_Restart_Required(t *testing.T) {
+	filename := writeConfig(t, testConfig)
+	defer os.RemoveAll(path.Dir(filename))
+	before, after := DefaultConfig(), DefaultConfig()
+	LoadConfig(filename, before)
+	LoadConfig(filename, after)
+	before.Validate()
+	after.Validate()
+
+	after.Expiration.Duration = time.Hour
+	after.Quotas = []string{"type:video/*=30%"}
+	after.Log.Level = "debug"
+	if changed := before.RestartRequired(after); len(changed) != 0 {
+		t.Errorf("Expected live settings not to require a restart, got %v", changed)
+	}
+
+	after.Policy = LFU
+	after.Upstream.MaxIdleConns = 10
+	changed := before.RestartRequired(after)
+	if len(changed) != 2 || changed[0] != "policy" || changed[1] != "upstream" {
+		t.Errorf("Expected policy and upstream to require a restart, got %v", changed)
+	}
+}
@@ -5,43 +5,73 @@ import (
 	"bytes"
 	"encoding/gob"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"hash/fnv"
 	"os"
-	"path"
 	"strings"
+	"sync"
 	"time"
 )
 
+const diskCacheStripes = 64
+
+// DiskCache persists entries to a Store, journaling every save and delete
+// so that entries left half written by a crash are discarded on startup.
+// Saves and deletes of different keys run concurrently, which lets their
+// journal records be group committed, while those of the same key keep
+// the order in which they were sent.
 type DiskCache struct {
-	Root string
-	DeleteChannel chan *DiskCacheEntry
-	SaveChannel chan *DiskCacheEntry
+	deleteChannel chan *DiskCacheEntry
+	saveChannel chan *DiskCacheEntry
 	journal *Journal
+	store Store
+	stripes [diskCacheStripes]diskCacheStripe
+	inFlight sync.WaitGroup
+	sizesLock sync.Mutex
+	sizes map[string]int64 //Encoded size of the entries on disk
+	usage int64
+	stop chan chan error
+	stopped chan struct{}
+}
+
+// diskCacheStripe queues the operations on the keys of a stripe, which run
+// one after the other in a goroutine of their own while any are pending.
+type diskCacheStripe struct {
+	sync.Mutex
+	pending []func()
+	running bool
 }
 
 type DiskCacheEntry struct {
 	Key string
+	URL string
 	Value Value
 	ExpirationTime time.Time
+	StoredTime time.Time
 	ContentType string
 	DoneChannel chan error
 }
 
-func NewDiskCache(cacheRoot string, logFile string) *DiskCache {
-	if _, err := os.Stat(cacheRoot); os.IsNotExist(err) {
-		log.Println(fmt.Sprintf("Diskcache root %s does not exist. Will create the diskcache root.", cacheRoot))
-		err := os.MkdirAll(cacheRoot, os.ModePerm)
+// NewDiskCache creates a DiskCache saving to store and journaling to
+// logFile, group committing journal records that arrive within
+// journalLatency of each other. Transactional stores are not journaled and
+// logFile is ignored.
+func NewDiskCache(store Store, logFile string, journalLatency time.Duration) *DiskCache {
+	var journal *Journal
+	if _, ok := store.(TransactionalStore); !ok {
+		var err error
+		journal, err = NewJournal(logFile, journalLatency)
 		if err != nil {
-			log.Fatal(err)
+			fatal(JournalComponent, "unable to recover journal", err)
 		}
 	}
-	journal, _ := NewJournal(logFile)
 	dc := &DiskCache{
-		Root: cacheRoot,
-		DeleteChannel: make (chan *DiskCacheEntry),
-		SaveChannel: make (chan *DiskCacheEntry),
+		deleteChannel: make (chan *DiskCacheEntry),
+		saveChannel: make (chan *DiskCacheEntry),
 		journal: journal,
+		store: store,
+		sizes: make(map[string]int64),
+		stop: make(chan chan error),
+		stopped: make(chan struct{}),
 	}
 
 	go dc.Run()
@@ -51,90 +81,265 @@ func NewDiskCache(cacheRoot string, logFile string) *DiskCache {
 func (dc *DiskCache) Run() {
 	for {
 		select {
-		case entry := <- dc.DeleteChannel:
-			dc.Delete(entry)
-		case entry := <- dc.SaveChannel:
-			dc.Save(entry)
+		case entry := <- dc.deleteChannel:
+			dc.dispatch(entry.Key, func() { dc.delete(entry) })
+		case entry := <- dc.saveChannel:
+			dc.dispatch(entry.Key, func() { dc.save(entry) })
+		case stop := <- dc.stop:
+			dc.inFlight.Wait()
+			close(dc.stopped)
+			var err error
+			if dc.journal != nil {
+				err = dc.journal.Close()
+			}
+			stop <- err
+			return
+		}
+	}
+}
+
+// dispatch queues op on the stripe of key, so that operations on a key run
+// in the order received without holding up Run, and operations on keys of
+// other stripes, while an earlier one is in progress.
+func (dc *DiskCache) dispatch(key string, op func()) {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	stripe := &dc.stripes[h.Sum32()%diskCacheStripes]
+
+	dc.inFlight.Add(1)
+	stripe.Lock()
+	stripe.pending = append(stripe.pending, op)
+	if stripe.running {
+		stripe.Unlock()
+		return
+	}
+	stripe.running = true
+	stripe.Unlock()
+	go dc.drain(stripe)
+}
+
+// drain runs the operations queued on stripe until none is left.
+func (dc *DiskCache) drain(stripe *diskCacheStripe) {
+	for {
+		stripe.Lock()
+		if len(stripe.pending) == 0 {
+			stripe.running = false
+			stripe.Unlock()
+			return
 		}
+		op := stripe.pending[0]
+		stripe.pending[0] = nil
+		stripe.pending = stripe.pending[1:]
+		stripe.Unlock()
+
+		op()
+		dc.inFlight.Done()
 	}
 }
 
-func (dc *DiskCache) Delete(entry *DiskCacheEntry) {
-	dc.journal.Delete <- entry.Key
-	deletePath := path.Join(dc.Root, entry.Key)
-	log.Println(fmt.Sprintf("Deleting entry from disk. Key: %s", entry.Key))
-	// Only returns error if path does not exist. This operation should
-	// be idempotent so multiple calls to remove on the same file
-	// shouldn't matter
-	_ = os.Remove(deletePath)
+// Put saves entry to disk and returns once it has been written.
+func (dc *DiskCache) Put(entry *DiskCacheEntry) error {
+	done := make(chan error)
+	entry.DoneChannel = done
+	select {
+	case dc.saveChannel <- entry:
+	case <-dc.stopped:
+		return ErrClosed
+	}
+	return <-done
+}
+
+// Remove deletes the entry stored under key from disk.
+func (dc *DiskCache) Remove(key string) error {
+	done := make(chan error)
+	select {
+	case dc.deleteChannel <- &DiskCacheEntry{Key: key, DoneChannel: done}:
+	case <-dc.stopped:
+		return ErrClosed
+	}
+	return <-done
+}
+
+// Close waits for the saves and deletes in progress and closes the journal.
+// The store is left open. Saving or deleting afterwards fails with
+// ErrClosed.
+func (dc *DiskCache) Close() error {
+	done := make(chan error)
+	select {
+	case dc.stop <- done:
+		return <-done
+	case <-dc.stopped:
+		return ErrClosed
+	}
+}
+
+func (dc *DiskCache) delete(entry *DiskCacheEntry) {
+	defer observeDisk("delete", time.Now())
+	if dc.journal != nil {
+		err := dc.journal.Append(DELETE, entry.Key)
+		if err != nil {
+			entry.DoneChannel <- err
+			close(entry.DoneChannel)
+			return
+		}
+	}
+	Log(DiskCacheComponent).Debug("delete", "key", entry.Key)
+	err := dc.store.Delete(entry.Key)
+	if err != nil {
+		Log(DiskCacheComponent).Error("unable to delete entry", "key", entry.Key, "error", err)
+		entry.DoneChannel <- err
+	} else {
+		dc.setSize(entry.Key, 0)
+	}
 	close(entry.DoneChannel)
 }
 
-func (dc *DiskCache) Save(entry *DiskCacheEntry) {
+func (dc *DiskCache) save(entry *DiskCacheEntry) {
+	defer observeDisk("save", time.Now())
 	response := &Response{
+		URL:entry.URL,
 		Body:entry.Value,
 		ContentType:entry.ContentType,
 		ExpirationTime:entry.ExpirationTime,
+		StoredTime:entry.StoredTime,
 	}
-	b, err := marshal(response)
+	b, err := encodeEntry(response)
 	if err != nil {
 		entry.DoneChannel <- err
 		close(entry.DoneChannel)
+		return
 	}
-	dc.journal.Add <- entry.Key
-	f, err := os.Create(path.Join(dc.Root, entry.Key))
+	err = dc.write(entry.Key, b)
 	if err != nil {
+		Log(DiskCacheComponent).Error("unable to save entry", "key", entry.Key, "error", err)
 	} else {
-		writer := bufio.NewWriter(f)
-		_, err = writer.Write(b)
-		writer.Flush()
-		f.Sync()
-		log.Println(fmt.Sprintf("Saved entry to disk. Key: %s", entry.Key))
-	}
-	f.Close()
-	dc.journal.AddAck <- entry.Key
+		Log(DiskCacheComponent).Debug("save", "key", entry.Key, "url", entry.URL, "bytes", len(b))
+	}
 	entry.DoneChannel <- err
 	close(entry.DoneChannel)
 }
 
+func (dc *DiskCache) write(key string, b []byte) error {
+	if dc.journal != nil {
+		err := dc.journal.Append(ADD, key)
+		if err != nil {
+			return err
+		}
+	}
+	err := dc.store.Put(key, b)
+	if err == nil && dc.journal != nil {
+		err = dc.journal.Append(ADDACK, key)
+	}
+	if err == nil {
+		dc.setSize(key, int64(len(b)))
+	}
+	return err
+}
 
-func (dc *DiskCache) Read(readChannel chan *DiskCacheEntry) {
-	files, err := ioutil.ReadDir(dc.Root)
+// setSize records that the entry of key takes size bytes on disk, 0 once it
+// is deleted.
+func (dc *DiskCache) setSize(key string, size int64) {
+	dc.sizesLock.Lock()
+	defer dc.sizesLock.Unlock()
+	dc.usage += size - dc.sizes[key]
+	if size == 0 {
+		delete(dc.sizes, key)
+	} else {
+		dc.sizes[key] = size
+	}
+}
+
+// Usage returns the bytes taken by the entries saved to disk, as encoded,
+// not counting the overhead of the store.
+func (dc *DiskCache) Usage() int64 {
+	dc.sizesLock.Lock()
+	defer dc.sizesLock.Unlock()
+	return dc.usage
+}
+
+// quarantine takes a corrupt entry out of the store, keeping a copy aside if
+// the store supports it, and journals its removal.
+func (dc *DiskCache) quarantine(key string) {
+	if dc.journal != nil {
+		err := dc.journal.Append(DELETE, key)
+		if err != nil {
+			Log(DiskCacheComponent).Error("unable to journal quarantine", "key", key, "error", err)
+			return
+		}
+	}
+	var err error
+	if q, ok := dc.store.(Quarantiner); ok {
+		err = q.Quarantine(key)
+	} else {
+		err = dc.store.Delete(key)
+	}
 	if err != nil {
-		log.Fatal(err)
+		Log(DiskCacheComponent).Error("unable to quarantine entry", "key", key, "error", err)
+		return
 	}
+	dc.setSize(key, 0)
+}
 
-	validEntries := parseLogs(dc.journal.file)
 
-	for _, f := range files {
-		filename := f.Name()
-		valid, ok := validEntries[filename]
-		if !ok || !valid {
-			log.Printf("Invalid file %s. Removing from disk.", filename)
-			err := os.Remove(path.Join(dc.Root, filename))
+func (dc *DiskCache) Read(readChannel chan *DiskCacheEntry) {
+	var validEntries map[string]bool
+	if dc.journal != nil {
+		validEntries = dc.journal.entries()
+	}
+	if fs, ok := dc.store.(*FileStore); ok {
+		err := fs.removeTempFiles()
+		if err != nil {
+			Log(DiskCacheComponent).Error("unable to remove temporary files", "error", err)
+		}
+	}
+
+	err := dc.store.Iterate(func(key string) error {
+		valid, ok := validEntries[key]
+		if dc.journal != nil && (!ok || !valid) {
+			Log(DiskCacheComponent).Warn("removing entry not acknowledged by the journal", "key", key)
+			err := dc.store.Delete(key)
 			if err != nil {
-				log.Println(err)
+				Log(DiskCacheComponent).Error("unable to delete entry", "key", key, "error", err)
 			}
-			continue
+			return nil
 		}
 
-		b, err := ioutil.ReadFile(path.Join(dc.Root, filename))
+		b, err := dc.store.Get(key)
 		if err != nil {
-			log.Fatal(err)
+			Log(DiskCacheComponent).Warn("quarantining unreadable entry", "key", key, "error", err)
+			dc.quarantine(key)
+			return nil
 		}
-		buf := bytes.NewBuffer(b)
-		decoder := gob.NewDecoder(buf)
-		resp, err := unmarshal(decoder)
+		resp, legacy, err := decodeEntry(b)
 		if err != nil {
-			log.Fatal(err)
+			Log(DiskCacheComponent).Warn("quarantining corrupt entry", "key", key)
+			dc.quarantine(key)
+			return nil
+		}
+		dc.setSize(key, int64(len(b)))
+		if legacy {
+			//Migrate entries written before the framed format in place
+			b, err = encodeEntry(resp)
+			if err == nil {
+				err = dc.write(key, b)
+			}
+			if err != nil {
+				Log(DiskCacheComponent).Error("unable to migrate entry", "key", key, "error", err)
+			}
 		}
 		entry := &DiskCacheEntry{
-			Key: f.Name(),
+			Key: key,
+			URL: resp.URL,
 			Value: resp.Body,
 			ExpirationTime:resp.ExpirationTime,
+			StoredTime:resp.StoredTime,
 			ContentType:resp.ContentType}
-		log.Println(fmt.Sprintf("Retrieved entry from disk. Key: %s", f.Name()))
+		Log(DiskCacheComponent).Debug("read", "key", key, "url", resp.URL)
 		readChannel <- entry
+		return nil
+	})
+	if err != nil {
+		fatal(DiskCacheComponent, "unable to read entries", err)
 	}
 	close(readChannel)
 }
@@ -158,36 +363,28 @@ func unmarshal(dec *gob.Decoder) (*Response, error) {
 	return &resp, nil
 }
 
-func parseLogs(filename string) map[string]bool {
-	f, err := os.OpenFile(filename, os.O_RDONLY, 0644)
-	if err != nil {
-		log.Println(err)
-	}
-	defer f.Close()
-	entries := make(map[string]bool)
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := strings.Split(scanner.Text()," ")
-		action := line[0]
-		key := line[1]
-
-		switch action {
-		case ADD:
-			entries[key] = false
-		case ADDACK:
-			entries[key] = true
-		case DELETE:
-			delete(entries, key)
-		}
-	}
-
-	return entries
-}
-
+// InvertedIndex maps hashed URLs back to the original URLs. When
+// CheckpointInterval is set, the mapping file is periodically rewritten
+// without the mappings that are no longer Live.
 type InvertedIndex struct {
 	Filename   string
+	Mappings   MappingStore //Persists mappings instead of Filename when set
 	Requests   chan MappingRequest
 	NewMapping chan Mapping
+	Live       func(hashed string) bool
+	CheckpointInterval time.Duration
+	lock       sync.Mutex
+	running    bool
+	closed     bool
+	err        error //Reported by Close once Run has returned
+	stop       chan chan error
+	stopped    chan struct{}
+}
+
+// MappingStore persists the mappings of an InvertedIndex.
+type MappingStore interface {
+	LoadMappings() (map[string]string, error)
+	PutMapping(mapping Mapping) error
 }
 
 type MappingRequest struct {
@@ -205,42 +402,195 @@ type Result struct {
 	ok bool
 }
 
-func (m *InvertedIndex) Run(loaded chan struct{}) chan struct{} {
-	invertedMap := m.loadMapping(m.Filename)
+// Run serves the mappings until Close is called, closing loaded once they
+// are loaded. It returns the error Close returns, if the mapping file could
+// not be opened or closed.
+func (m *InvertedIndex) Run(loaded chan struct{}) error {
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		close(loaded)
+		return ErrClosed
+	}
+	m.running = true
+	m.stop = make(chan chan error)
+	m.stopped = make(chan struct{})
+	m.lock.Unlock()
+
+	var openErr error
+	var invertedMap map[string]string
+	var save func(mapping Mapping)
+	var checkpoint func(touched map[string]bool)
+	var file *os.File
+	if m.Mappings != nil {
+		var err error
+		invertedMap, err = m.Mappings.LoadMappings()
+		if err != nil {
+			fatal(IndexComponent, "unable to load mappings", err)
+		}
+		save = func(mapping Mapping) {
+			err := m.Mappings.PutMapping(mapping)
+			if err != nil {
+				Log(IndexComponent).Error("unable to save mapping", "url", mapping.Original, "error", err)
+			}
+		}
+	} else {
+		invertedMap = m.loadMapping(m.Filename)
+		file, openErr = os.OpenFile(m.Filename, os.O_CREATE | os.O_APPEND | os.O_WRONLY, 0644)
+		if openErr != nil {
+			//Mappings are still served, and saved by the next checkpoint
+			Log(IndexComponent).Error("unable to open mapping file", "file", m.Filename, "error", openErr)
+			file = nil
+		}
+		save = func(mapping Mapping) {
+			if file == nil {
+				return
+			}
+			_, err := fmt.Fprintf(file,"%s %s\n", mapping.Hashed, mapping.Original)
+			if err != nil {
+				Log(IndexComponent).Error("unable to save mapping", "url", mapping.Original, "error", err)
+			}
+		}
+		checkpoint = func(touched map[string]bool) {
+			file = m.checkpoint(file, invertedMap, touched)
+		}
+	}
 	close(loaded)
-	file, _ := os.OpenFile(m.Filename, os.O_CREATE | os.O_APPEND | os.O_WRONLY, 0644)
+
+	var tick <-chan time.Time
+	if checkpoint != nil && m.CheckpointInterval > 0 {
+		ticker := time.NewTicker(m.CheckpointInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	touched := make(map[string]bool)
 
 	for {
 		select {
 		case newEntry := <- m.NewMapping:
+			touched[newEntry.Hashed] = true
 			_, ok := invertedMap[newEntry.Hashed]
 			if !ok {
 				invertedMap[newEntry.Hashed] = newEntry.Original
-				fmt.Fprintf(file,"%s %s\n", newEntry.Hashed, newEntry.Original)
+				save(newEntry)
 			}
 		case request :=<- m.Requests:
 			original, ok := invertedMap[request.hashed]
+			if ok {
+				touched[request.hashed] = true
+			}
 			request.response <- Result{original:original, ok:ok}
+		case <- tick:
+			checkpoint(touched)
+			touched = make(map[string]bool)
+		case stop := <- m.stop:
+			err := openErr
+			if file != nil {
+				if closeErr := file.Close(); err == nil {
+					err = closeErr
+				}
+			}
+			m.err = err
+			close(m.stopped)
+			stop <- err
+			return err
 		}
 	}
 }
 
+// checkpoint rewrites the mapping file with only the live mappings and
+// returns the reopened file. A mapping stays live while its entry is cached
+// or while it has been used since the previous checkpoint, so pages that
+// were just rewritten keep resolving their resources.
+func (m *InvertedIndex) checkpoint(file *os.File, invertedMap map[string]string, touched map[string]bool) *os.File {
+	before := len(invertedMap)
+	if m.Live != nil {
+		for hashed := range invertedMap {
+			if !touched[hashed] && !m.Live(hashed) {
+				delete(invertedMap, hashed)
+			}
+		}
+	}
+	err := writeFileAtomically(m.Filename, func(w *bufio.Writer) error {
+		for hashed, original := range invertedMap {
+			_, err := fmt.Fprintf(w, "%s %s\n", hashed, original)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		Log(IndexComponent).Error("checkpoint failed", "error", err)
+		return file
+	}
+	if file != nil {
+		file.Close()
+	}
+	file, err = os.OpenFile(m.Filename, os.O_CREATE | os.O_APPEND | os.O_WRONLY, 0644)
+	if err != nil {
+		fatal(IndexComponent, "unable to reopen mapping file", err)
+	}
+	Log(IndexComponent).Info("checkpoint written", "mappings", len(invertedMap), "before", before)
+	return file
+}
+
 func (m *InvertedIndex) loadMapping(filename string) map[string]string {
-	file, err := os.OpenFile(filename, os.O_RDONLY | os.O_CREATE | os.O_APPEND, 0644)
+	entries, err := ReadMappings(filename)
 	if err != nil {
-		log.Fatal(err)
+		fatal(IndexComponent, "unable to read mappings", err)
 	}
-	defer file.Close()
+	return entries
+}
 
+// ReadMappings reads a mapping file, skipping malformed lines. A missing
+// file has no mappings.
+func ReadMappings(filename string) (map[string]string, error) {
 	entries := make(map[string]string)
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		line := strings.Split(scanner.Text()," ")
+		line := strings.SplitN(scanner.Text(), " ", 2)
+		if len(line) != 2 {
+			continue
+		}
 		hashed := line[0]
 		original := line[1]
 		entries[hashed] = original
 	}
-	return entries
+	return entries, scanner.Err()
+}
+
+// Close closes the mapping file once the mappings sent before are saved,
+// and returns the error of opening or closing it. Closing it again returns
+// ErrClosed, and an index closed before it runs does not run.
+func (m *InvertedIndex) Close() error {
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		return ErrClosed
+	}
+	m.closed = true
+	running := m.running
+	m.lock.Unlock()
+	if !running {
+		return nil
+	}
+	done := make(chan error)
+	select {
+	case m.stop <- done:
+		return <-done
+	case <-m.stopped:
+		return m.err
+	}
 }
 
 func (m *InvertedIndex) Get(key string) (string, bool) {
@@ -0,0 +1,198 @@
+package webcache
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func Test_DiskCache_Put_Read_Remove(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "diskcache")
+	defer os.RemoveAll(dir)
+	store := NewMemoryStore()
+	dc := NewDiskCache(store, path.Join(dir, "journal.log"), 0)
+
+	stored := time.Now().Add(-time.Minute).Round(0)
+	expiration := time.Now().Add(time.Minute).Round(0)
+	for _, url := range []string{"http://a.com/1", "http://a.com/2"} {
+		err := dc.Put(&DiskCacheEntry{Key: Hash(url), URL: url, Value: Value(url), ContentType: "text/plain", ExpirationTime: expiration, StoredTime: stored})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	dc.Remove(Hash("http://a.com/1"))
+
+	//An entry that was never journaled should be discarded on read
+	store.Put("orphan", []byte("orphan"))
+
+	readChannel := make(chan *DiskCacheEntry)
+	go dc.Read(readChannel)
+	var entries []*DiskCacheEntry
+	for entry := range readChannel {
+		entries = append(entries, entry)
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(entries))
+	}
+	entry := entries[0]
+	if entry.Key != Hash("http://a.com/2") || entry.URL != "http://a.com/2" || string(entry.Value) != "http://a.com/2" {
+		t.Errorf("Expected entry for http://a.com/2, got %s %s", entry.Key, entry.URL)
+	}
+	if entry.ContentType != "text/plain" || !entry.ExpirationTime.Equal(expiration) || !entry.StoredTime.Equal(stored) {
+		t.Errorf("Expected metadata to round trip, got %s %s %s", entry.ContentType, entry.ExpirationTime, entry.StoredTime)
+	}
+	if _, err := store.Get("orphan"); err != ErrNotFound {
+		t.Errorf("Expected orphaned entry to be removed from the store")
+	}
+	b, _ := store.Get(Hash("http://a.com/2"))
+	if dc.Usage() != int64(len(b)) {
+		t.Errorf("Expected %d bytes on disk, got %d", len(b), dc.Usage())
+	}
+}
+
+func Test_DiskCache_Close(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "diskcache")
+	defer os.RemoveAll(dir)
+	logFile := path.Join(dir, "journal.log")
+	dc := NewDiskCache(NewMemoryStore(), logFile, 0)
+	for _, url := range []string{"http://a.com/1", "http://a.com/2"} {
+		dc.Put(&DiskCacheEntry{Key: Hash(url), URL: url, Value: Value(url)})
+	}
+
+	err := dc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.Put(&DiskCacheEntry{Key: Hash("http://a.com/3"), URL: "http://a.com/3"}); err != ErrClosed {
+		t.Errorf("Expected saving after closing to fail with ErrClosed, got %v", err)
+	}
+	if err := dc.Close(); err != ErrClosed {
+		t.Errorf("Expected closing twice to fail with ErrClosed, got %v", err)
+	}
+
+	//Closing checkpoints the journal, leaving an empty log behind the snapshot
+	info, _ := os.Stat(logFile)
+	if info.Size() != int64(len(journalMagic)) {
+		t.Errorf("Expected an empty log, it is %d bytes", info.Size())
+	}
+	entries := ReadJournal(logFile)
+	if len(entries) != 2 || !entries[Hash("http://a.com/1")] || !entries[Hash("http://a.com/2")] {
+		t.Errorf("Expected 2 acknowledged entries, got %v", entries)
+	}
+}
+
+// blockingStore holds the saves of a key until it is released.
+type blockingStore struct {
+	Store
+	key     string
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) Put(key string, value []byte) error {
+	if key == s.key {
+		s.started <- struct{}{}
+		<-s.release
+	}
+	return s.Store.Put(key, value)
+}
+
+func Test_DiskCache_Stripes(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "diskcache")
+	defer os.RemoveAll(dir)
+	store := &blockingStore{Store: NewMemoryStore(), key: "slow", started: make(chan struct{}, 2), release: make(chan struct{})}
+	dc := NewDiskCache(store, path.Join(dir, "journal.log"), 0)
+	defer dc.Close()
+
+	saved := make(chan error, 2)
+	for _, value := range []string{"first", "second"} {
+		go func(value string) {
+			saved <- dc.Put(&DiskCacheEntry{Key: "slow", Value: Value(value)})
+		}(value)
+		if value == "first" {
+			<-store.started
+		}
+	}
+	//Let the second save of the slow key reach its stripe
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error)
+	go func() { done <- dc.Put(&DiskCacheEntry{Key: "fast", Value: Value("fast")}) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected the save of an unrelated key to succeed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected the save of an unrelated key not to wait for a slow key")
+	}
+
+	close(store.release)
+	for i := 0; i < 2; i++ {
+		if err := <-saved; err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, _ := store.Get("slow")
+	entry, _, _ := decodeEntry(b)
+	if entry == nil || string(entry.Body) != "second" {
+		t.Errorf("Expected the saves of a key to run in order, got %v", entry)
+	}
+}
+
+func Test_InvertedIndex_Close(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "index")
+	defer os.RemoveAll(dir)
+	index := &InvertedIndex{
+		Filename:   path.Join(dir, MappingFilename),
+		Requests:   make(chan MappingRequest),
+		NewMapping: make(chan Mapping),
+	}
+	loaded := make(chan struct{})
+	go index.Run(loaded)
+	<-loaded
+	index.NewMapping <- Mapping{Original: "http://a.com/1", Hashed: Hash("http://a.com/1")}
+
+	err := index.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mappings, _ := ReadMappings(index.Filename)
+	if mappings[Hash("http://a.com/1")] != "http://a.com/1" {
+		t.Errorf("Expected the mapping to be saved, got %v", mappings)
+	}
+	if err := index.Close(); err != ErrClosed {
+		t.Errorf("Expected ErrClosed closing the index again, got %v", err)
+	}
+
+	idle := &InvertedIndex{Filename: index.Filename}
+	if err := idle.Close(); err != nil {
+		t.Errorf("Expected an index that never ran to close, got %v", err)
+	}
+	if err := idle.Run(make(chan struct{})); err != ErrClosed {
+		t.Errorf("Expected a closed index not to run, got %v", err)
+	}
+}
+
+func Test_InvertedIndex_Open_Error(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "index")
+	defer os.RemoveAll(dir)
+	index := &InvertedIndex{
+		Filename:   path.Join(dir, "missing", MappingFilename),
+		Requests:   make(chan MappingRequest),
+		NewMapping: make(chan Mapping),
+	}
+	loaded := make(chan struct{})
+	go index.Run(loaded)
+	<-loaded
+	index.NewMapping <- Mapping{Original: "http://a.com/1", Hashed: Hash("http://a.com/1")}
+	if original, ok := index.Get(Hash("http://a.com/1")); !ok || original != "http://a.com/1" {
+		t.Errorf("Expected the mapping to be served, got %s, %v", original, ok)
+	}
+	if err := index.Close(); err == nil {
+		t.Errorf("Expected the error opening the mapping file")
+	}
+}
@@ -6,18 +6,28 @@ import (
 )
 
 type Response struct {
+	URL string
 	ExpirationTime time.Time
+	StoredTime time.Time //When the response was cached, zero for entries stored before it was recorded
 	Body Value
 	ContentType string
+	StatusCode int //Status of a response fetched from the origin server, cached responses are 200 OK
 	//Size int
 }
 
+// EntryOverhead approximates the bookkeeping cost of a single entry (map
+// entry, policy list element, journal records and the file on disk) in
+// bytes. It is accounted into the size of every entry so that many tiny
+// responses cannot exhaust memory or inodes without approaching capacity.
+const EntryOverhead = 512
+
 type Entry struct {
 	Key            string
 	//Value          Value
 	*Response
 	Size           int
 	//ExpirationTime time.Time
+	Served         uint64 //Requests served from the entry, whatever the policy
 	hits           uint64
 	tick           uint64
 	element        *list.Element
@@ -29,7 +39,7 @@ func NewEntry(key string, response *Response) *Entry {
 		Key:            key,
 		//Value:          value,
 		Response: response,
-		Size:           len(response.Body),
+		Size:           EntrySize(response.Body),
 		//ExpirationTime: ExpirationTime,
 		hits:           0,
 		tick:           0,
@@ -37,6 +47,11 @@ func NewEntry(key string, response *Response) *Entry {
 	}
 }
 
+// EntrySize returns the capacity an entry with the given body takes up.
+func EntrySize(body Value) int {
+	return len(body) + EntryOverhead
+}
+
 func (entry *Entry) Less(other *Entry) bool {
 	if entry.hits < other.hits { return true }
 	if entry.hits == other.hits { return entry.tick < other.tick
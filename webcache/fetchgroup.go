@@ -0,0 +1,57 @@
+package webcache
+
+import (
+	"context"
+	"sync"
+)
+
+// FetchGroup tracks the fetches from origin servers in progress by URL, so
+// that requests for a URL being fetched wait for that fetch instead of
+// fetching it again.
+type FetchGroup struct {
+	sync.Mutex
+	fetches map[string]*fetchCall
+}
+
+type fetchCall struct {
+	done     chan struct{}
+	response *Response
+	err      error
+}
+
+func NewFetchGroup() *FetchGroup {
+	return &FetchGroup{fetches: make(map[string]*fetchCall)}
+}
+
+// Do runs fetch for url, unless url is already being fetched, in which case
+// it waits for that fetch, or for ctx to be done, and returns its result.
+// shared reports whether the result came from another fetch.
+func (g *FetchGroup) Do(ctx context.Context, url string, fetch func() (*Response, error)) (response *Response, shared bool, err error) {
+	g.Lock()
+	if call, ok := g.fetches[url]; ok {
+		g.Unlock()
+		response, err = call.wait(ctx)
+		return response, true, err
+	}
+	call := &fetchCall{done: make(chan struct{})}
+	g.fetches[url] = call
+	g.Unlock()
+
+	defer func() {
+		g.Lock()
+		delete(g.fetches, url)
+		g.Unlock()
+		close(call.done)
+	}()
+	call.response, call.err = fetch()
+	return call.response, false, call.err
+}
+
+func (c *fetchCall) wait(ctx context.Context) (*Response, error) {
+	select {
+	case <-c.done:
+		return c.response, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,58 @@
+package webcache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_FetchGroup_Do(t *testing.T) {
+	g := NewFetchGroup()
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var fetched int32
+	fetch := func() (*Response, error) {
+		if atomic.AddInt32(&fetched, 1) == 1 {
+			close(started)
+			<-release
+		}
+		return &Response{URL: "http://a.com/style.css", Body: Value("body")}, nil
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, shared, _ := g.Do(context.Background(), "http://a.com/style.css", fetch)
+		if shared {
+			t.Errorf("Expected the first fetch not to be shared")
+		}
+	}()
+	<-started
+
+	var attached int32
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, shared, err := g.Do(context.Background(), "http://a.com/style.css", fetch)
+			if err != nil || !shared || string(response.Body) != "body" {
+				t.Errorf("Expected the response of the fetch in progress, got %v, %v, %v", response, err, shared)
+			}
+			atomic.AddInt32(&attached, 1)
+		}()
+	}
+	//Let the requests reach the fetch in progress
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if fetched != 1 {
+		t.Errorf("Expected a single fetch, got %d", fetched)
+	}
+	if attached != 4 {
+		t.Errorf("Expected 4 requests to share the fetch, got %d", attached)
+	}
+}
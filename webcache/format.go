@@ -0,0 +1,105 @@
+package webcache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"time"
+)
+
+// Entries are stored framed as
+//
+//	magic "WCEF" | version (1) | metadata length (4) | body length (8) | checksum (4) | metadata | body
+//
+// where the CRC32C checksum covers the rest of the header, the gob encoded
+// metadata and the body.
+const (
+	EntryFormatVersion = 1
+
+	entryHeaderSize = 21
+)
+
+var entryMagic = []byte("WCEF")
+
+var ErrCorruptEntry = errors.New("corrupt disk cache entry")
+
+type entryMetadata struct {
+	URL            string
+	ExpirationTime time.Time
+	StoredTime     time.Time
+	ContentType    string
+}
+
+func encodeEntry(response *Response) ([]byte, error) {
+	var meta bytes.Buffer
+	err := gob.NewEncoder(&meta).Encode(&entryMetadata{
+		URL:            response.URL,
+		ExpirationTime: response.ExpirationTime,
+		StoredTime:     response.StoredTime,
+		ContentType:    response.ContentType,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, entryHeaderSize, entryHeaderSize+meta.Len()+len(response.Body))
+	copy(b, entryMagic)
+	b[4] = EntryFormatVersion
+	binary.BigEndian.PutUint32(b[5:9], uint32(meta.Len()))
+	binary.BigEndian.PutUint64(b[9:17], uint64(len(response.Body)))
+	b = append(b, meta.Bytes()...)
+	b = append(b, response.Body...)
+	binary.BigEndian.PutUint32(b[17:21], entryChecksum(b))
+	return b, nil
+}
+
+// DecodeEntry decodes a stored disk cache entry.
+func DecodeEntry(b []byte) (*Response, error) {
+	response, _, err := decodeEntry(b)
+	return response, err
+}
+
+// decodeEntry decodes an entry written by encodeEntry. Entries written
+// before the framed format existed are raw gob encoded Responses; they are
+// still decoded, and legacy is set so that they can be rewritten.
+func decodeEntry(b []byte) (response *Response, legacy bool, err error) {
+	if !bytes.HasPrefix(b, entryMagic) {
+		response, err = unmarshal(gob.NewDecoder(bytes.NewReader(b)))
+		if err != nil {
+			return nil, true, ErrCorruptEntry
+		}
+		return response, true, nil
+	}
+
+	if len(b) < entryHeaderSize || b[4] != EntryFormatVersion {
+		return nil, false, ErrCorruptEntry
+	}
+	metaLength := uint64(binary.BigEndian.Uint32(b[5:9]))
+	bodyLength := binary.BigEndian.Uint64(b[9:17])
+	if uint64(len(b)-entryHeaderSize) != metaLength+bodyLength {
+		return nil, false, ErrCorruptEntry
+	}
+	if binary.BigEndian.Uint32(b[17:21]) != entryChecksum(b) {
+		return nil, false, ErrCorruptEntry
+	}
+
+	var meta entryMetadata
+	err = gob.NewDecoder(bytes.NewReader(b[entryHeaderSize : entryHeaderSize+metaLength])).Decode(&meta)
+	if err != nil {
+		return nil, false, ErrCorruptEntry
+	}
+	return &Response{
+		URL:            meta.URL,
+		ExpirationTime: meta.ExpirationTime,
+		StoredTime:     meta.StoredTime,
+		ContentType:    meta.ContentType,
+		Body:           b[entryHeaderSize+metaLength:],
+	}, false, nil
+}
+
+func entryChecksum(b []byte) uint32 {
+	crc := crc32.Checksum(b[:17], castagnoli)
+	return crc32.Update(crc, castagnoli, b[entryHeaderSize:])
+}
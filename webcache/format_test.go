@@ -0,0 +1,70 @@
+package webcache
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func Test_Entry_Format_Round_Trip(t *testing.T) {
+	expiration := time.Now().Round(0)
+	b, err := encodeEntry(&Response{URL: "http://a.com/", Body: Value("body"), ContentType: "text/html", ExpirationTime: expiration})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, legacy, err := decodeEntry(b)
+	if err != nil || legacy {
+		t.Fatalf("Expected framed entry to decode, got %v (legacy %t)", err, legacy)
+	}
+	if response.URL != "http://a.com/" || string(response.Body) != "body" || response.ContentType != "text/html" || !response.ExpirationTime.Equal(expiration) {
+		t.Errorf("Expected entry to round trip, got %+v", response)
+	}
+
+	for i := range b {
+		corrupt := append([]byte(nil), b...)
+		corrupt[i] ^= 0x40
+		if _, _, err := decodeEntry(corrupt); err == nil {
+			t.Errorf("Expected flipped byte %d to be detected", i)
+		}
+	}
+	if _, _, err := decodeEntry(b[:len(b)-1]); err != ErrCorruptEntry {
+		t.Errorf("Expected truncated entry to be detected")
+	}
+}
+
+func Test_DiskCache_Read_Quarantines_And_Migrates(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "diskcache")
+	defer os.RemoveAll(dir)
+	store, _ := NewFileStore(path.Join(dir, "diskcache"))
+	dc := NewDiskCache(store, path.Join(dir, "journal.log"), 0)
+
+	good, legacy, corrupt := Hash("http://a.com/good"), Hash("http://a.com/legacy"), Hash("http://a.com/corrupt")
+	dc.Put(&DiskCacheEntry{Key: good, URL: "http://a.com/good", Value: Value("good")})
+	dc.Put(&DiskCacheEntry{Key: corrupt, URL: "http://a.com/corrupt", Value: Value("corrupt")})
+	b, _ := marshal(&Response{URL: "http://a.com/legacy", Body: Value("legacy")})
+	dc.write(legacy, b)
+
+	b, _ = store.Get(corrupt)
+	b[len(b)-1] ^= 0xff
+	ioutil.WriteFile(path.Join(store.Root, corrupt), b, 0644)
+
+	readChannel := make(chan *DiskCacheEntry)
+	go dc.Read(readChannel)
+	read := make(map[string]string)
+	for entry := range readChannel {
+		read[entry.Key] = string(entry.Value)
+	}
+
+	if len(read) != 2 || read[good] != "good" || read[legacy] != "legacy" {
+		t.Errorf("Expected good and legacy entries, got %v", read)
+	}
+	if _, err := os.Stat(path.Join(dir, "quarantine", corrupt)); err != nil {
+		t.Errorf("Expected corrupt entry to be quarantined: %s", err)
+	}
+	b, _ = store.Get(legacy)
+	if _, wasLegacy, err := decodeEntry(b); err != nil || wasLegacy {
+		t.Errorf("Expected legacy entry to be migrated to the framed format")
+	}
+}
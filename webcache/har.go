@@ -0,0 +1,395 @@
+package webcache
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Cache statuses of requests, as recorded in the _cacheStatus field of HAR
+// entries.
+const (
+	CacheHit     = "HIT"
+	CacheMiss    = "MISS"
+	CacheExpired = "EXPIRED"
+	CacheStale   = "STALE" //An expired entry served without fetching it again
+)
+
+const DefaultHARFlushInterval = 5 * time.Second
+
+// HAR is an HTTP Archive 1.2 document, see
+// http://www.softwareishard.com/blog/har-12-spec/. Only the fields the
+// cache reads or writes are declared.
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string      `json:"version"`
+	Creator HARCreator  `json:"creator"`
+	Entries []*HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HAREntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	CacheStatus     string      `json:"_cacheStatus,omitempty"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// CachedResponse returns the response of a HAR entry that can be cached: a
+// successful GET whose body was recorded.
+func (e *HAREntry) CachedResponse() (*Response, error) {
+	if e.Request.Method != http.MethodGet {
+		return nil, errors.New(fmt.Sprintf("Not a GET request [%s %s]", e.Request.Method, e.Request.URL))
+	}
+	if e.Response.Status != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("Response for %s has status %d", e.Request.URL, e.Response.Status))
+	}
+	content := e.Response.Content
+	if content.Text == "" && content.Size > 0 {
+		return nil, errors.New(fmt.Sprintf("Body of %s was not recorded", e.Request.URL))
+	}
+
+	body := Value(content.Text)
+	if content.Encoding == "base64" {
+		b, err := base64.StdEncoding.DecodeString(content.Text)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid body for %s: %s", e.Request.URL, err))
+		}
+		body = b
+	}
+	contentType := content.MimeType
+	for _, header := range e.Response.Headers {
+		if http.CanonicalHeaderKey(header.Name) == "Content-Type" {
+			contentType = header.Value
+		}
+	}
+	return &Response{URL: e.Request.URL, Body: body, ContentType: contentType}, nil
+}
+
+// ImportHAR caches the successful GET responses recorded in a HAR file
+// through Admit, like ImportWARC. It returns the number of responses cached.
+func ImportHAR(r io.Reader, wc Cache, dc *DiskCache, index *InvertedIndex) (int, error) {
+	var har HAR
+	err := json.NewDecoder(r).Decode(&har)
+	if err != nil {
+		return 0, err
+	}
+	imported := 0
+	for _, entry := range har.Log.Entries {
+		response, err := entry.CachedResponse()
+		if err != nil {
+			Log(ImportComponent).Warn("skipping HAR entry", "error", err)
+			continue
+		}
+
+		cached, err := Admit(wc, dc, response.URL, response.Body, response.ContentType)
+		if err != nil {
+			return imported, err
+		}
+		if cached {
+			if index != nil {
+				index.NewMapping <- Mapping{Original: response.URL, Hashed: Hash(response.URL)}
+			}
+			imported++
+		}
+	}
+	return imported, nil
+}
+
+// HARRecorder records the traffic served by a proxy to a HAR file. Entries
+// are appended to the file every FlushInterval, or as soon as
+// harFlushEntries of them are waiting, and the file is left a complete HAR
+// document after every write, so only the entries not written yet are kept
+// in memory. Response bodies are not recorded.
+type HARRecorder struct {
+	Filename      string
+	FlushInterval time.Duration
+	file          *os.File
+	end           int64 //Offset of the end of the entries written
+	written       int
+	pending       []*HAREntry
+	entries       chan *HAREntry
+	stop          chan chan error
+	stopped       chan struct{}
+}
+
+const (
+	harFlushEntries = 256
+	harFooter       = "\n]}}\n"
+)
+
+// NewHARRecorder creates filename, replacing any previous recording, and
+// starts recording to it.
+func NewHARRecorder(filename string, flushInterval time.Duration) (*HARRecorder, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	creator, err := json.Marshal(HARCreator{Name: "webcache", Version: "1.0"})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	header := fmt.Sprintf(`{"log": {"version": "1.2", "creator": %s, "entries": [`, creator)
+	_, err = file.WriteString(header + harFooter)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	h := &HARRecorder{
+		Filename:      filename,
+		FlushInterval: flushInterval,
+		file:          file,
+		end:           int64(len(header)),
+		entries:       make(chan *HAREntry),
+		stop:          make(chan chan error),
+		stopped:       make(chan struct{}),
+	}
+	go h.Run()
+	return h, nil
+}
+
+func (h *HARRecorder) Run() {
+	ticker := time.NewTicker(h.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case entry := <-h.entries:
+			h.pending = append(h.pending, entry)
+			if len(h.pending) >= harFlushEntries {
+				h.logFlush()
+			}
+		case <-ticker.C:
+			h.logFlush()
+		case done := <-h.stop:
+			close(h.stopped)
+			err := h.flush()
+			closeErr := h.file.Close()
+			if err == nil {
+				err = closeErr
+			}
+			done <- err
+			return
+		}
+	}
+}
+
+func (h *HARRecorder) logFlush() {
+	err := h.flush()
+	if err != nil {
+		Log(ProxyComponent).Error("unable to write HAR file", "file", h.Filename, "error", err)
+	}
+}
+
+// flush appends the pending entries to the file, overwriting its footer
+// with them and writing it again after them. The pending entries are
+// dropped if they cannot be written.
+func (h *HARRecorder) flush() error {
+	if len(h.pending) == 0 {
+		return nil
+	}
+	pending := h.pending
+	h.pending = nil
+
+	var buf bytes.Buffer
+	written := h.written
+	for _, entry := range pending {
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if written > 0 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n")
+		buf.Write(b)
+		written++
+	}
+	end := h.end + int64(buf.Len())
+	buf.WriteString(harFooter)
+	_, err := h.file.WriteAt(buf.Bytes(), h.end)
+	if err != nil {
+		return err
+	}
+	h.end = end
+	h.written = written
+	return nil
+}
+
+// Record queues entry to be written to the file. Entries recorded once the
+// recorder is closed are dropped.
+func (h *HARRecorder) Record(entry *HAREntry) {
+	select {
+	case h.entries <- entry:
+	case <-h.stopped:
+	}
+}
+
+// Close writes the entries left to the file and stops recording. Closing
+// twice fails with ErrClosed.
+func (h *HARRecorder) Close() error {
+	done := make(chan error)
+	select {
+	case h.stop <- done:
+		return <-done
+	case <-h.stopped:
+		return ErrClosed
+	}
+}
+
+// Handler serves requests with handle, which returns the cache status of
+// each request or "" if it was not cacheable, and records them.
+func (h *HARRecorder) Handler(handle func(http.ResponseWriter, *http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := &recordingResponseWriter{ResponseWriter: w}
+		cacheStatus := handle(rw, r)
+		h.Record(newHAREntry(r, rw, start, cacheStatus))
+	})
+}
+
+// recordingResponseWriter remembers the status and size of a response.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func newHAREntry(r *http.Request, w *recordingResponseWriter, start time.Time, cacheStatus string) *HAREntry {
+	elapsed := float64(time.Since(start)) / float64(time.Millisecond)
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	var query []HARNameValue
+	for name, values := range r.URL.Query() {
+		for _, value := range values {
+			query = append(query, HARNameValue{Name: name, Value: value})
+		}
+	}
+	if query == nil {
+		query = []HARNameValue{}
+	}
+
+	return &HAREntry{
+		StartedDateTime: start,
+		Time:            elapsed,
+		Request: HARRequest{
+			Method:      r.Method,
+			URL:         r.URL.String(),
+			HTTPVersion: r.Proto,
+			Cookies:     harCookies(r.Cookies()),
+			Headers:     harHeaders(r.Header),
+			QueryString: query,
+			HeadersSize: -1,
+			BodySize:    r.ContentLength,
+		},
+		Response: HARResponse{
+			Status:      status,
+			StatusText:  http.StatusText(status),
+			HTTPVersion: r.Proto,
+			Cookies:     []HARNameValue{},
+			Headers:     harHeaders(w.Header()),
+			Content:     HARContent{Size: w.size, MimeType: w.Header().Get("Content-Type")},
+			RedirectURL: w.Header().Get("Location"),
+			HeadersSize: -1,
+			BodySize:    w.size,
+		},
+		//The proxy does not observe the phases of a request, so the whole
+		//time is accounted as waiting
+		Timings:     HARTimings{Send: 0, Wait: elapsed, Receive: 0},
+		CacheStatus: cacheStatus,
+	}
+}
+
+func harHeaders(header http.Header) []HARNameValue {
+	headers := []HARNameValue{}
+	for name, values := range header {
+		for _, value := range values {
+			headers = append(headers, HARNameValue{Name: name, Value: value})
+		}
+	}
+	return headers
+}
+
+func harCookies(cookies []*http.Cookie) []HARNameValue {
+	values := []HARNameValue{}
+	for _, cookie := range cookies {
+		values = append(values, HARNameValue{Name: cookie.Name, Value: cookie.Value})
+	}
+	return values
+}
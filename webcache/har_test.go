@@ -0,0 +1,158 @@
+package webcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testHAR = `{"log": {"version": "1.2", "creator": {"name": "test", "version": "1"}, "entries": [
+	{"request": {"method": "GET", "url": "http://a.com/"},
+	 "response": {"status": 200, "headers": [{"name": "content-type", "value": "text/html; charset=utf-8"}],
+	              "content": {"size": 13, "mimeType": "text/html", "text": "<html></html>"}}},
+	{"request": {"method": "GET", "url": "http://a.com/logo.png"},
+	 "response": {"status": 200, "content": {"size": 4, "mimeType": "image/png", "text": "iVBORw==", "encoding": "base64"}}},
+	{"request": {"method": "GET", "url": "http://a.com/missing"},
+	 "response": {"status": 404, "content": {"size": 0, "mimeType": "text/html"}}},
+	{"request": {"method": "POST", "url": "http://a.com/form"},
+	 "response": {"status": 200, "content": {"size": 2, "mimeType": "text/plain", "text": "ok"}}},
+	{"request": {"method": "GET", "url": "http://a.com/video.mp4"},
+	 "response": {"status": 200, "content": {"size": 1000, "mimeType": "video/mp4"}}}
+]}}`
+
+func Test_HAR_Import(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "har")
+	defer os.RemoveAll(dir)
+
+	store := NewMemoryStore()
+	dc := NewDiskCache(store, path.Join(dir, "journal.log"), 0)
+	wc := NewWebCache(NewLRUPolicy(), 1, 60, 0, nil)
+	imported, err := ImportHAR(strings.NewReader(testHAR), wc, dc, nil)
+	if err != nil || imported != 2 {
+		t.Fatalf("Expected 2 imported entries, got %d (%v)", imported, err)
+	}
+
+	response, err := wc.Get(Hash("http://a.com/"))
+	if err != nil || string(response.Body) != "<html></html>" || response.ContentType != "text/html; charset=utf-8" {
+		t.Errorf("Expected text entry to be imported with its Content-Type header, got %+v (%v)", response, err)
+	}
+	response, err = wc.Get(Hash("http://a.com/logo.png"))
+	if err != nil || string(response.Body) != "\x89PNG" || response.ContentType != "image/png" {
+		t.Errorf("Expected base64 entry to be decoded, got %+v (%v)", response, err)
+	}
+	if _, err := store.Get(Hash("http://a.com/logo.png")); err != nil {
+		t.Errorf("Expected imported entry on disk: %s", err)
+	}
+}
+
+func Test_HAR_Recorder(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "har")
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "traffic.har")
+
+	recorder, err := NewHARRecorder(filename, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := recorder.Handler(func(w http.ResponseWriter, r *http.Request) string {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return CacheMiss
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("hello"))
+		return CacheHit
+	})
+	for _, url := range []string{"http://a.com/hello?x=1", "http://a.com/missing"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil))
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var har HAR
+	if err := json.Unmarshal(b, &har); err != nil {
+		t.Fatal(err)
+	}
+	if har.Log.Version != "1.2" || len(har.Log.Entries) != 2 {
+		t.Fatalf("Expected 2 recorded entries, got %d", len(har.Log.Entries))
+	}
+	hit, miss := har.Log.Entries[0], har.Log.Entries[1]
+	if hit.CacheStatus != CacheHit || hit.Response.Status != 200 || hit.Response.BodySize != 5 || hit.Response.Content.MimeType != "text/plain" {
+		t.Errorf("Expected recorded hit, got %+v", hit.Response)
+	}
+	if len(hit.Request.QueryString) != 1 || hit.Request.QueryString[0].Name != "x" {
+		t.Errorf("Expected query string to be recorded, got %+v", hit.Request.QueryString)
+	}
+	if miss.CacheStatus != CacheMiss || miss.Response.Status != 404 {
+		t.Errorf("Expected recorded miss, got %s %d", miss.CacheStatus, miss.Response.Status)
+	}
+	if hit.Time < 0 || hit.Timings.Wait != hit.Time {
+		t.Errorf("Expected timings to add up to the entry time, got %f and %+v", hit.Time, hit.Timings)
+	}
+}
+
+func Test_HAR_Recorder_Streaming(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "har")
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "traffic.har")
+	recorder, err := NewHARRecorder(filename, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readEntries := func() int {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var har HAR
+		if err := json.Unmarshal(b, &har); err != nil {
+			t.Fatalf("Expected a complete HAR document, got %s", err)
+		}
+		return len(har.Log.Entries)
+	}
+	if n := readEntries(); n != 0 {
+		t.Errorf("Expected no entries, got %d", n)
+	}
+
+	//Recording the entry after a full batch waits for the batch to be written
+	for i := 0; i <= harFlushEntries; i++ {
+		recorder.Record(&HAREntry{Request: HARRequest{Method: "GET", URL: fmt.Sprintf("http://a.com/%d", i)}})
+	}
+	if n := readEntries(); n != harFlushEntries {
+		t.Errorf("Expected %d entries to be written, got %d", harFlushEntries, n)
+	}
+
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := readEntries(); n != harFlushEntries+1 {
+		t.Errorf("Expected %d entries once closed, got %d", harFlushEntries+1, n)
+	}
+
+	recorded := make(chan struct{})
+	go func() {
+		recorder.Record(&HAREntry{})
+		close(recorded)
+	}()
+	select {
+	case <-recorded:
+	case <-time.After(time.Second):
+		t.Errorf("Expected recording after closing not to block")
+	}
+	if err := recorder.Close(); err != ErrClosed {
+		t.Errorf("Expected closing twice to fail with ErrClosed, got %v", err)
+	}
+}
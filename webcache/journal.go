@@ -1,52 +1,181 @@
 package webcache
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"log"
+	"hash/crc32"
+	"io/ioutil"
 	"os"
+	"path"
+	"strings"
+	"time"
 )
 
 const ADD = "ADD"
 const ADDACK = "ADDACK"
 const DELETE = "DELETE"
 
+const DefaultCheckpointSize = 4 << 20
+const DefaultCheckpointInterval = 10 * time.Minute
+const DefaultJournalLatency = 2 * time.Millisecond
+const maxJournalBatch = 1024
+
+// Journal files start with journalMagic followed by records of
+//
+//	length (4) | checksum (4) | sequence (8) | action (1) | key
+//
+// where length counts the bytes after the checksum, which is a CRC32C over
+// them. Sequence numbers increase within a file. Recovery stops at the
+// first record that is torn, fails its checksum or is out of sequence.
+const journalMagic = "WCJ1"
+const journalRecordHeaderSize = 8
+const maxJournalKeyLength = 1024
+
+var journalActions = map[string]byte{ADD: 1, ADDACK: 2, DELETE: 3}
+
+// Journal records saves and deletes of disk cache entries. Records sent
+// concurrently are group committed: the journal waits up to maxLatency after
+// the first record of a batch for more, writes the batch, fsyncs once and
+// only then acknowledges every record on its Done channel.
+//
+// Once the log grows past CheckpointSize, or CheckpointInterval has passed,
+// the live state is written to a snapshot and the log is truncated, so
+// recovery only reads the snapshot and the tail of the log written since.
 type Journal struct {
-	Add chan string
-	AddAck chan string
-	Delete chan string
+	Add chan *JournalRecord
+	AddAck chan *JournalRecord
+	Delete chan *JournalRecord
+	CheckpointSize int64
+	CheckpointInterval time.Duration
+	maxLatency time.Duration
 	file string
+	seq uint64
+	stop chan chan error
+	stopped chan struct{}
+}
+
+var ErrClosed = errors.New("closed")
+
+var ErrCorruptJournal = errors.New("journal is in neither the binary nor the text format")
+
+type JournalRecord struct {
+	Key  string
+	Done chan error //Receives the result once the record is durable. Must be buffered or received from.
+	action string
 }
 
-func NewJournal(filename string) (*Journal, error) {
+func NewJournal(filename string, maxLatency time.Duration) (*Journal, error) {
 	journal := &Journal{
-		Add: make(chan string),
-		AddAck: make(chan string),
-		Delete: make(chan string),
+		Add: make(chan *JournalRecord),
+		AddAck: make(chan *JournalRecord),
+		Delete: make(chan *JournalRecord),
+		CheckpointSize: DefaultCheckpointSize,
+		CheckpointInterval: DefaultCheckpointInterval,
+		maxLatency: maxLatency,
 		file: filename,
 	}
-	done := journal.Run()
-	<- done
+	file, size, err := journal.open()
+	if err != nil {
+		return nil, err
+	}
+	<- journal.run(file, size)
 	return journal, nil
 }
 
-func (j *Journal) Run() chan struct{} {
-	done := make(chan struct{})
+// Append journals action for key and returns once the record is on disk.
+func (j *Journal) Append(action string, key string) error {
+	if len(key) > maxJournalKeyLength {
+		return errors.New(fmt.Sprintf("Journal key longer than %d bytes", maxJournalKeyLength))
+	}
+	record := &JournalRecord{Key: key, Done: make(chan error, 1)}
+	var records chan *JournalRecord
+	switch action {
+	case ADD:
+		records = j.Add
+	case ADDACK:
+		records = j.AddAck
+	case DELETE:
+		records = j.Delete
+	default:
+		return errors.New(fmt.Sprintf("Invalid journal action [%s]", action))
+	}
+	select {
+	case records <- record:
+	case <-j.stopped:
+		return ErrClosed
+	}
+	return <-record.Done
+}
+
+// Close checkpoints the journal, so that the next recovery only has to
+// read the snapshot, and closes the log. Appending afterwards fails with
+// ErrClosed.
+func (j *Journal) Close() error {
+	done := make(chan error)
+	select {
+	case j.stop <- done:
+		return <-done
+	case <-j.stopped:
+		return ErrClosed
+	}
+}
+
+// open opens and recovers the log, returning it along with its size.
+func (j *Journal) open() (*os.File, int64, error) {
 	file, err := os.OpenFile(j.file, os.O_CREATE | os.O_APPEND | os.O_RDWR, 0644)
 	if err != nil {
-		log.Fatal(err)
+		return nil, 0, err
 	}
+	size, err := j.recover(file)
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, size, nil
+}
+
+// run appends records to the recovered log file, holding size bytes.
+func (j *Journal) run(file *os.File, size int64) chan struct{} {
+	done := make(chan struct{})
+	j.stop = make(chan chan error)
+	j.stopped = make(chan struct{})
 
 	go func() {
-		defer file.Close()
+		var tick <-chan time.Time
+		if j.CheckpointInterval > 0 {
+			ticker := time.NewTicker(j.CheckpointInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
 		close(done)
 		for {
+			var record *JournalRecord
 			select {
-			case entry := <- j.Add:
-				j.log(file, ADD, entry)
-			case entry := <- j.AddAck:
-				j.log(file, ADDACK, entry)
-			case entry := <- j.Delete:
-				j.log(file, DELETE, entry)
+			case record = <- j.Add:
+				record.action = ADD
+			case record = <- j.AddAck:
+				record.action = ADDACK
+			case record = <- j.Delete:
+				record.action = DELETE
+			case <- tick:
+				if size > int64(len(journalMagic)) && j.checkpoint(file) {
+					size = int64(len(journalMagic))
+				}
+				continue
+			case stop := <- j.stop:
+				if size > int64(len(journalMagic)) {
+					j.checkpoint(file)
+				}
+				close(j.stopped)
+				stop <- file.Close()
+				return
+			}
+			size += j.commit(file, j.collect(record))
+			if j.CheckpointSize > 0 && size >= j.CheckpointSize && j.checkpoint(file) {
+				size = int64(len(journalMagic))
 			}
 		}
 		//file.Close()
@@ -54,10 +183,323 @@ func (j *Journal) Run() chan struct{} {
 	return done
 }
 
-func (j *Journal) log(file *os.File, action string, key string) {
-	_, err := fmt.Fprintf(file,"%s %s\n", action, key)
+// collect gathers the records sent within maxLatency of first into a batch.
+func (j *Journal) collect(first *JournalRecord) []*JournalRecord {
+	batch := []*JournalRecord{first}
+	var deadline <-chan time.Time
+	if j.maxLatency > 0 {
+		timer := time.NewTimer(j.maxLatency)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	for len(batch) < maxJournalBatch {
+		var record *JournalRecord
+		var action string
+		if deadline != nil {
+			select {
+			case record = <- j.Add:
+				action = ADD
+			case record = <- j.AddAck:
+				action = ADDACK
+			case record = <- j.Delete:
+				action = DELETE
+			case <- deadline:
+				return batch
+			}
+		} else {
+			select {
+			case record = <- j.Add:
+				action = ADD
+			case record = <- j.AddAck:
+				action = ADDACK
+			case record = <- j.Delete:
+				action = DELETE
+			default:
+				return batch
+			}
+		}
+		record.action = action
+		batch = append(batch, record)
+	}
+	return batch
+}
+
+// commit writes and fsyncs the batch, then acknowledges its records.
+func (j *Journal) commit(file *os.File, batch []*JournalRecord) int64 {
+	var buf bytes.Buffer
+	for _, record := range batch {
+		j.seq++
+		buf.Write(encodeJournalRecord(j.seq, record.action, record.Key))
+	}
+	n, err := file.Write(buf.Bytes())
+	if err == nil {
+		start := time.Now()
+		err = file.Sync()
+		journalFsyncDuration.Observe(time.Since(start).Seconds())
+	}
+	if err != nil {
+		Log(JournalComponent).Error("unable to commit records", "records", len(batch), "error", err)
+	}
+	for _, record := range batch {
+		if record.Done != nil {
+			record.Done <- err
+		}
+	}
+	return int64(n)
+}
+
+func (j *Journal) snapshotFile() string {
+	return j.file + ".snapshot"
+}
+
+// entries returns the state recorded by the snapshot and the log.
+func (j *Journal) entries() map[string]bool {
+	return ReadJournal(j.file)
+}
+
+// checkpoint replaces the snapshot with the current state and truncates the
+// log. A crash after the snapshot is renamed into place but before the log
+// is truncated is harmless, since replaying the log again on top of the
+// snapshot yields the same state.
+func (j *Journal) checkpoint(file *os.File) bool {
+	entries := j.entries()
+	err := j.writeSnapshot(entries)
+	if err == nil {
+		err = file.Truncate(int64(len(journalMagic)))
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		Log(JournalComponent).Error("checkpoint failed", "error", err)
+		return false
+	}
+	Log(JournalComponent).Info("checkpoint written", "entries", len(entries))
+	return true
+}
+
+func (j *Journal) writeSnapshot(entries map[string]bool) error {
+	return writeFileAtomically(j.snapshotFile(), func(w *bufio.Writer) error {
+		w.WriteString(journalMagic)
+		for key, acked := range entries {
+			action := ADD
+			if acked {
+				action = ADDACK
+			}
+			j.seq++
+			_, err := w.Write(encodeJournalRecord(j.seq, action, key))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// recover replays the snapshot and the log to find the last sequence number
+// and truncates the log after its last valid record. A journal in the old
+// text format is migrated into a snapshot. It returns the size of the log.
+func (j *Journal) recover(file *os.File) (int64, error) {
+	entries := make(map[string]bool)
+	_, snapshotSeq, _, err := replayJournal(j.snapshotFile(), entries)
 	if err != nil {
-		log.Println(err)
+		return 0, err
 	}
+	valid, seq, legacy, err := replayJournal(j.file, entries)
+	if err != nil {
+		return 0, err
+	}
+	j.seq = snapshotSeq
+	if seq > j.seq {
+		j.seq = seq
+	}
+
+	if legacy {
+		Log(JournalComponent).Info("migrating text journal", "file", j.file, "entries", len(entries))
+		err = j.writeSnapshot(entries)
+		if err != nil {
+			return 0, err
+		}
+		valid = 0
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() > valid {
+		if !legacy {
+			Log(JournalComponent).Warn("truncating journal after a torn or corrupt record", "file", j.file, "offset", valid)
+		}
+		err = file.Truncate(valid)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if valid == 0 {
+		_, err = file.WriteString(journalMagic)
+		if err != nil {
+			return 0, err
+		}
+		valid = int64(len(journalMagic))
+	}
+	return valid, file.Sync()
+}
+
+// ReadJournal returns the state recorded in the journal logFile and its
+// snapshot without opening it for writing: every key still in the journal,
+// mapped to whether its save was acknowledged.
+func ReadJournal(logFile string) map[string]bool {
+	return parseLogs(logFile+".snapshot", logFile)
 }
 
+// parseLogs replays the journal files in order and returns every key still
+// in the journal, mapped to whether its save was acknowledged.
+func parseLogs(filenames ...string) map[string]bool {
+	entries := make(map[string]bool)
+	for _, filename := range filenames {
+		_, _, _, err := replayJournal(filename, entries)
+		if err != nil {
+			Log(JournalComponent).Error("unable to replay journal", "file", filename, "error", err)
+		}
+	}
+	return entries
+}
+
+// replayJournal applies the records of filename to entries. It returns the
+// length of the valid prefix of the file and the last sequence number in
+// it. Journals in the old text format are replayed line by line, skipping
+// malformed lines, and reported as legacy. Files in neither format, such as
+// binary journals with a corrupt header, are left alone and reported with
+// ErrCorruptJournal.
+func replayJournal(filename string, entries map[string]bool) (valid int64, seq uint64, legacy bool, err error) {
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return 0, 0, false, nil
+	}
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if !bytes.HasPrefix(b, []byte(journalMagic)) {
+		if bytes.HasPrefix([]byte(journalMagic), b) {
+			//Empty, or the header itself was torn
+			return 0, 0, false, nil
+		}
+		if !isTextJournal(b) {
+			return 0, 0, false, ErrCorruptJournal
+		}
+		replayTextJournal(b, entries)
+		return int64(len(b)), 0, true, nil
+	}
+
+	offset := len(journalMagic)
+	for len(b)-offset >= journalRecordHeaderSize {
+		length := int(binary.BigEndian.Uint32(b[offset : offset+4]))
+		if length < 9 || length > 9+maxJournalKeyLength || len(b)-offset-journalRecordHeaderSize < length {
+			break
+		}
+		body := b[offset+journalRecordHeaderSize : offset+journalRecordHeaderSize+length]
+		if crc32.Checksum(body, castagnoli) != binary.BigEndian.Uint32(b[offset+4:offset+8]) {
+			break
+		}
+		recordSeq := binary.BigEndian.Uint64(body[0:8])
+		if recordSeq <= seq {
+			break
+		}
+		key := string(body[9:])
+		switch body[8] {
+		case journalActions[ADD]:
+			entries[key] = false
+		case journalActions[ADDACK]:
+			entries[key] = true
+		case journalActions[DELETE]:
+			delete(entries, key)
+		default:
+			return int64(offset), seq, false, nil
+		}
+		seq = recordSeq
+		offset += journalRecordHeaderSize + length
+	}
+	return int64(offset), seq, false, nil
+}
+
+// isTextJournal reports whether b is in the old text format: printable lines
+// starting with an action, the last of which may be torn.
+func isTextJournal(b []byte) bool {
+	for _, c := range b {
+		if c != '\n' && c != '\r' && c != '\t' && (c < ' ' || c > '~') {
+			return false
+		}
+	}
+	lines := strings.Split(string(b), "\n")
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if _, ok := journalActions[fields[0]]; ok {
+			continue
+		}
+		torn := strings.HasPrefix(ADDACK, fields[0]) || strings.HasPrefix(DELETE, fields[0])
+		if i != len(lines)-1 || len(fields) != 1 || !torn {
+			return false
+		}
+	}
+	return true
+}
+
+func replayTextJournal(b []byte, entries map[string]bool) {
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		switch fields[0] {
+		case ADD:
+			entries[fields[1]] = false
+		case ADDACK:
+			entries[fields[1]] = true
+		case DELETE:
+			delete(entries, fields[1])
+		}
+	}
+}
+
+func encodeJournalRecord(seq uint64, action string, key string) []byte {
+	b := make([]byte, journalRecordHeaderSize+9+len(key))
+	binary.BigEndian.PutUint32(b[0:4], uint32(9+len(key)))
+	binary.BigEndian.PutUint64(b[8:16], seq)
+	b[16] = journalActions[action]
+	copy(b[17:], key)
+	binary.BigEndian.PutUint32(b[4:8], crc32.Checksum(b[8:], castagnoli))
+	return b
+}
+
+// writeFileAtomically writes filename through a synced temporary file that
+// is renamed into place.
+func writeFileAtomically(filename string, write func(w *bufio.Writer) error) error {
+	tmp := filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(path.Dir(filename))
+}
@@ -0,0 +1,251 @@
+package webcache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_Journal_Checkpoint(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "journal")
+	defer os.RemoveAll(dir)
+	j, err := NewJournal(path.Join(dir, "journal.log"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	//The threshold is only read once records are committed
+	j.CheckpointSize = 200
+
+	for i := 0; i < 10; i++ {
+		key := Hash(string(rune('a' + i)))
+		j.Append(ADD, key)
+		j.Append(ADDACK, key)
+		if i%2 == 0 {
+			j.Append(DELETE, key)
+		}
+	}
+	j.Append(ADD, "pending")
+
+	if _, err := os.Stat(j.snapshotFile()); err != nil {
+		t.Fatalf("Expected a snapshot once the log passed its size threshold: %s", err)
+	}
+	info, _ := os.Stat(j.file)
+	if info.Size() >= j.CheckpointSize {
+		t.Errorf("Expected log to be truncated behind the snapshot, it is %d bytes", info.Size())
+	}
+
+	entries := j.entries()
+	if len(entries) != 6 || entries["pending"] {
+		t.Errorf("Expected 5 acknowledged and 1 pending entry, got %v", entries)
+	}
+	for i := 0; i < 10; i++ {
+		if acked := entries[Hash(string(rune('a'+i)))]; acked != (i%2 == 1) {
+			t.Errorf("Unexpected state %t for entry %d", acked, i)
+		}
+	}
+}
+
+func Test_Journal_Group_Commit(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "journal")
+	defer os.RemoveAll(dir)
+	j, _ := NewJournal(path.Join(dir, "journal.log"), 20*time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			if err := j.Append(ADD, key); err != nil {
+				t.Error(err)
+			}
+			if err := j.Append(ADDACK, key); err != nil {
+				t.Error(err)
+			}
+		}(Hash(strconv.Itoa(i)))
+	}
+	wg.Wait()
+
+	//Every acknowledged record must already be in the log
+	entries := j.entries()
+	if len(entries) != 50 {
+		t.Fatalf("Expected 50 entries, got %d", len(entries))
+	}
+	for key, acked := range entries {
+		if !acked {
+			t.Errorf("Expected %s to be acknowledged", key)
+		}
+	}
+	if err := j.Append("BOGUS", "key"); err == nil {
+		t.Errorf("Expected invalid action to be rejected")
+	}
+}
+
+type journalOp struct {
+	action string
+	key    string
+}
+
+var journalTestOps = []journalOp{
+	{ADD, "a"}, {ADDACK, "a"}, {ADD, "b"}, {ADD, "c"}, {ADDACK, "c"},
+	{DELETE, "a"}, {ADDACK, "b"}, {ADD, "d"}, {DELETE, "c"}, {ADDACK, "d"},
+}
+
+// writeTestJournal writes the journal file for journalTestOps and returns
+// it along with the state after every prefix of the operations.
+func writeTestJournal() ([]byte, []map[string]bool) {
+	b := []byte(journalMagic)
+	states := []map[string]bool{{}}
+	state := make(map[string]bool)
+	for i, op := range journalTestOps {
+		b = append(b, encodeJournalRecord(uint64(i+1), op.action, op.key)...)
+		replayTextJournal([]byte(op.action+" "+op.key), state)
+		prefix := make(map[string]bool)
+		for k, v := range state {
+			prefix[k] = v
+		}
+		states = append(states, prefix)
+	}
+	return b, states
+}
+
+// checkJournalRecovery opens a journal over data and checks that recovery
+// yields the state of a prefix of journalTestOps and leaves a journal that
+// new records can be appended to.
+func checkJournalRecovery(t *testing.T, data []byte, states []map[string]bool) {
+	dir, _ := ioutil.TempDir("", "journal")
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "journal.log")
+	ioutil.WriteFile(filename, data, 0644)
+
+	j, err := NewJournal(filename, 0)
+	if err != nil {
+		if err != ErrCorruptJournal || bytes.HasPrefix(data, []byte(journalMagic)) {
+			t.Fatalf("Expected the journal to be recovered, got %s", err)
+		}
+		kept, _ := ioutil.ReadFile(filename)
+		if !bytes.Equal(kept, data) {
+			t.Errorf("Expected a journal with a corrupt header to be left untouched")
+		}
+		return
+	}
+	defer j.Close()
+	recovered := j.entries()
+	prefix := false
+	for _, state := range states {
+		if reflect.DeepEqual(state, recovered) || (len(state) == 0 && len(recovered) == 0) {
+			prefix = true
+		}
+	}
+	if !prefix {
+		t.Fatalf("Recovered state %v is not the state of any prefix of the journal", recovered)
+	}
+
+	if err := j.Append(ADDACK, "new"); err != nil {
+		t.Fatal(err)
+	}
+	if !j.entries()["new"] {
+		t.Errorf("Expected record appended after recovery to be replayed")
+	}
+}
+
+func Test_Journal_Torn_Tail(t *testing.T) {
+	data, states := writeTestJournal()
+	for cut := 0; cut <= len(data); cut++ {
+		checkJournalRecovery(t, data[:cut], states)
+	}
+}
+
+func Test_Journal_Random_Corruption(t *testing.T) {
+	data, states := writeTestJournal()
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		corrupt := append([]byte(nil), data...)
+		for n := random.Intn(3) + 1; n > 0; n-- {
+			corrupt[random.Intn(len(corrupt))] = byte(random.Intn(256))
+		}
+		checkJournalRecovery(t, corrupt[:random.Intn(len(corrupt)+1)], states)
+	}
+}
+
+func Test_Journal_Migrates_Text_Format(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "journal")
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "journal.log")
+	ioutil.WriteFile(filename, []byte("ADD a\nADDACK a\nADD b\nDELETE\n\nADDACK c\nADD"), 0644)
+
+	j, err := NewJournal(filename, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	entries := j.entries()
+	if len(entries) != 3 || !entries["a"] || entries["b"] || !entries["c"] {
+		t.Errorf("Expected a and c acknowledged and b pending, got %v", entries)
+	}
+	data, _ := ioutil.ReadFile(filename)
+	if string(data) != journalMagic {
+		t.Errorf("Expected migrated log to be reset to the binary format")
+	}
+}
+
+func Test_Journal_Corrupt_Header(t *testing.T) {
+	data, _ := writeTestJournal()
+	data[1] ^= 0x40
+	dir, _ := ioutil.TempDir("", "journal")
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "journal.log")
+	ioutil.WriteFile(filename, data, 0644)
+
+	_, err := NewJournal(filename, 0)
+	if err != ErrCorruptJournal {
+		t.Errorf("Expected a binary journal with a corrupt header to be refused, got %v", err)
+	}
+	kept, _ := ioutil.ReadFile(filename)
+	if !bytes.Equal(kept, data) {
+		t.Errorf("Expected the journal to be left untouched")
+	}
+}
+
+func FuzzJournalRecovery(f *testing.F) {
+	data, states := writeTestJournal()
+	f.Add(uint(len(data)), uint(0), byte(0))
+	f.Add(uint(len(data)-3), uint(7), byte(0xff))
+	f.Add(uint(20), uint(30), byte(1))
+	f.Fuzz(func(t *testing.T, cut uint, offset uint, value byte) {
+		corrupt := append([]byte(nil), data...)
+		corrupt[offset%uint(len(corrupt))] ^= value
+		corrupt = corrupt[:cut%uint(len(corrupt)+1)]
+		checkJournalRecovery(t, corrupt, states)
+	})
+}
+
+func FuzzJournalReplay(f *testing.F) {
+	data, _ := writeTestJournal()
+	f.Add(data)
+	f.Add([]byte("ADD a\nADDACK"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		entries := make(map[string]bool)
+		dir, _ := ioutil.TempDir("", "journal")
+		defer os.RemoveAll(dir)
+		filename := path.Join(dir, "journal.log")
+		ioutil.WriteFile(filename, data, 0644)
+		valid, _, legacy, err := replayJournal(filename, entries)
+		if err == ErrCorruptJournal {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !legacy && (valid > int64(len(data)) || valid < 0) {
+			t.Errorf("Valid prefix %d outside of %d bytes", valid, len(data))
+		}
+	})
+}
@@ -1,10 +1,89 @@
 package webcache
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
+// Components of the package, logged in the component field.
+const (
+	CacheComponent     = "cache"
+	PolicyComponent    = "policy"
+	DiskCacheComponent = "diskcache"
+	StoreComponent     = "store"
+	JournalComponent   = "journal"
+	IndexComponent     = "index"
+	ImportComponent    = "import"
+	WarmupComponent    = "warmup"
+	AdminComponent     = "admin"
+	ProxyComponent     = "proxy"
+)
+
+// Log formats.
+const (
+	TextFormat     = "text"
+	JSONFormat     = "json"
+	CombinedFormat = "combined"
+)
+
+var (
+	loggerLock       sync.RWMutex
+	rootLogger       = slog.New(slog.NewTextHandler(os.Stderr, nil))
+	componentLoggers = make(map[string]*slog.Logger)
+)
+
+// NewLogger creates a logger writing records of at least level to w, in
+// the text or json format.
+func NewLogger(w io.Writer, format string, level slog.Level) (*slog.Logger, error) {
+	options := &slog.HandlerOptions{Level: level}
+	switch format {
+	case TextFormat:
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case JSONFormat:
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	}
+	return nil, errors.New(fmt.Sprintf("Invalid log format [%s]", format))
+}
+
+// SetLogger sets the logger the package logs to.
+func SetLogger(logger *slog.Logger) {
+	loggerLock.Lock()
+	defer loggerLock.Unlock()
+	rootLogger = logger
+	componentLoggers = make(map[string]*slog.Logger)
+}
+
+// Log returns the logger of a component.
+func Log(component string) *slog.Logger {
+	loggerLock.RLock()
+	logger, ok := componentLoggers[component]
+	loggerLock.RUnlock()
+	if ok {
+		return logger
+	}
+
+	loggerLock.Lock()
+	defer loggerLock.Unlock()
+	logger = rootLogger.With("component", component)
+	componentLoggers[component] = logger
+	return logger
+}
+
+// fatal logs err and exits.
+func fatal(component string, msg string, err error) {
+	Log(component).Error(msg, "error", err)
+	os.Exit(1)
+}
+
 func BytesToMegabyte(b int) string {
 	const unit = 1000
 	if b < unit {
@@ -19,5 +98,130 @@ func BytesToMegabyte(b int) string {
 }
 
 func CacheStatus(current int, max int) {
-	log.Print(fmt.Sprintf("CAPACITY - %s of %s", BytesToMegabyte(current), BytesToMegabyte(max)))
+	Log(CacheComponent).Debug("capacity", "used_bytes", current, "max_bytes", max)
+}
+
+func QuotaStatus(quota string, current int, max int) {
+	Log(CacheComponent).Debug("quota", "quota", quota, "used_bytes", current, "max_bytes", max)
+}
+
+func EntryStatus(current int, max int) {
+	Log(CacheComponent).Debug("entries", "entries", current, "max_entries", max)
+}
+
+// AccessLog writes a line per request served by the proxy, either in the
+// combined log format followed by the cache status and the duration in
+// seconds, or as JSON.
+type AccessLog struct {
+	sync.Mutex
+	w      io.Writer
+	format string
+}
+
+type accessRecord struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	Method    string    `json:"method"`
+	URL       string    `json:"url"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Duration  float64   `json:"duration"`
+	Cache     string    `json:"cache"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// NewAccessLog creates an access log writing to w, or a disabled one if w
+// is nil.
+func NewAccessLog(w io.Writer, format string) (*AccessLog, error) {
+	a := &AccessLog{}
+	return a, a.Reset(w, format)
+}
+
+// Reset makes the access log write to w in the given format from now on,
+// or disables it if w is nil.
+func (a *AccessLog) Reset(w io.Writer, format string) error {
+	if format != CombinedFormat && format != JSONFormat {
+		return errors.New(fmt.Sprintf("Invalid access log format [%s]", format))
+	}
+	a.Lock()
+	defer a.Unlock()
+	a.w = w
+	a.format = format
+	return nil
+}
+
+// Handler wraps a handler returning the cache status of each request, like
+// the one HARRecorder.Handler takes, to log its requests.
+func (a *AccessLog) Handler(handle func(http.ResponseWriter, *http.Request) string) func(http.ResponseWriter, *http.Request) string {
+	return func(w http.ResponseWriter, r *http.Request) string {
+		start := time.Now()
+		rw := &recordingResponseWriter{ResponseWriter: w}
+		cacheStatus := handle(rw, r)
+		status := rw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		client := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			client = host
+		}
+		a.write(&accessRecord{
+			Time:      start,
+			Client:    client,
+			Method:    r.Method,
+			URL:       r.URL.String(),
+			Proto:     r.Proto,
+			Status:    status,
+			Bytes:     rw.size,
+			Duration:  time.Since(start).Seconds(),
+			Cache:     cacheStatus,
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+		})
+		return cacheStatus
+	}
+}
+
+func (a *AccessLog) write(record *accessRecord) {
+	a.Lock()
+	defer a.Unlock()
+	if a.w == nil {
+		return
+	}
+
+	var line []byte
+	if a.format == JSONFormat {
+		line, _ = json.Marshal(record)
+		line = append(line, '\n')
+	} else {
+		line = []byte(fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %d %s %s %s %.6f\n",
+			record.Client,
+			record.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			record.Method, record.URL, record.Proto,
+			record.Status, record.Bytes,
+			quoteOrDash(record.Referer), quoteOrDash(record.UserAgent),
+			dashIfEmpty(record.Cache), record.Duration))
+	}
+
+	_, err := a.w.Write(line)
+	if err != nil {
+		Log(ProxyComponent).Error("unable to write access log", "error", err)
+	}
+}
+
+func quoteOrDash(s string) string {
+	if s == "" {
+		return "\"-\""
+	}
+	return "\"" + strings.Replace(s, "\"", "\\\"", -1) + "\""
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
 }
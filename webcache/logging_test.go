@@ -0,0 +1,88 @@
+package webcache
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func Test_Logging_Components(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := NewLogger(&buf, JSONFormat, slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetLogger(logger)
+	defer SetLogger(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+
+	Log(JournalComponent).Info("checkpoint written", "entries", 3)
+	Log(PolicyComponent).Debug("evict", "key", "a")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected debug records to be dropped, got %q", buf.String())
+	}
+	var record map[string]interface{}
+	err = json.Unmarshal([]byte(lines[0]), &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record["component"] != JournalComponent || record["level"] != "INFO" || record["entries"] != float64(3) {
+		t.Errorf("Expected a journal info record with 3 entries, got %v", record)
+	}
+
+	_, err = NewLogger(&buf, "xml", slog.LevelInfo)
+	if err == nil {
+		t.Errorf("Expected an invalid log format to be rejected")
+	}
+}
+
+func Test_AccessLog_Combined(t *testing.T) {
+	var buf bytes.Buffer
+	accessLog, _ := NewAccessLog(&buf, CombinedFormat)
+	handle := accessLog.Handler(func(w http.ResponseWriter, r *http.Request) string {
+		w.Write([]byte("hello"))
+		return CacheHit
+	})
+	r := httptest.NewRequest("GET", "http://a.com/page", nil)
+	r.RemoteAddr = "10.0.0.1:5000"
+	r.Header.Set("User-Agent", "test")
+	handle(httptest.NewRecorder(), r)
+
+	expected := regexp.MustCompile(`^10\.0\.0\.1 - - \[[^\]]+\] "GET http://a\.com/page HTTP/1\.1" 200 5 "-" "test" HIT [0-9.]+\n$`)
+	if !expected.MatchString(buf.String()) {
+		t.Errorf("Expected a combined log line, got %q", buf.String())
+	}
+}
+
+func Test_AccessLog_JSON(t *testing.T) {
+	var buf bytes.Buffer
+	accessLog, _ := NewAccessLog(&buf, JSONFormat)
+	handle := accessLog.Handler(func(w http.ResponseWriter, r *http.Request) string {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return CacheMiss
+	})
+	r := httptest.NewRequest("GET", "http://a.com/page", nil)
+	r.RemoteAddr = "10.0.0.1:5000"
+	handle(httptest.NewRecorder(), r)
+
+	var record accessRecord
+	err := json.Unmarshal(buf.Bytes(), &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Client != "10.0.0.1" || record.URL != "http://a.com/page" || record.Status != http.StatusServiceUnavailable || record.Bytes != 12 || record.Cache != CacheMiss {
+		t.Errorf("Expected a 503 MISS for http://a.com/page of 12 bytes, got %+v", record)
+	}
+
+	_, err = NewAccessLog(&buf, TextFormat)
+	if err == nil {
+		t.Errorf("Expected an invalid access log format to be rejected")
+	}
+}
@@ -0,0 +1,206 @@
+package webcache
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Request outcomes reported by webcache_requests_total. Requests the cache
+// does not handle, every method but GET, are bypassed. Expired entries served
+// without fetching them again are stale.
+const (
+	OutcomeHit     = "hit"
+	OutcomeMiss    = "miss"
+	OutcomeExpired = "expired"
+	OutcomeStale   = "stale"
+	OutcomeBypass  = "bypass"
+)
+
+// Prefetch results reported by webcache_prefetches_total.
+const (
+	PrefetchFetched   = "fetched"
+	PrefetchCached    = "cached"
+	PrefetchFailed    = "failed"
+	PrefetchCancelled = "cancelled"
+	PrefetchRejected  = "rejected" //The prefetch queue was full
+)
+
+var latencyBuckets = prometheus.ExponentialBuckets(0.0001, 2, 16) //100µs to ~3s
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webcache_requests_total",
+		Help: "Requests served by the proxy, by method and cache outcome.",
+	}, []string{"method", "outcome"})
+
+	responseBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webcache_response_bytes_total",
+		Help: "Response body bytes served by the proxy, by cache outcome.",
+	}, []string{"outcome"})
+
+	upstreamDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "webcache_upstream_request_duration_seconds",
+		Help:    "Time until the response headers of requests to origin servers were received.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	evictionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webcache_evictions_total",
+		Help: "Entries evicted by the replacement policy.",
+	}, []string{"policy"})
+
+	diskDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "webcache_disk_operation_duration_seconds",
+		Help:    "Time taken to save entries to and delete entries from disk, journaling included.",
+		Buckets: latencyBuckets,
+	}, []string{"operation"})
+
+	journalFsyncDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "webcache_journal_fsync_duration_seconds",
+		Help:    "Time taken to fsync a group commit of journal records.",
+		Buckets: latencyBuckets,
+	})
+
+	prefetchesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webcache_prefetches_total",
+		Help: "Resources embedded in HTML pages that were prefetched, by result.",
+	}, []string{"result"})
+
+	prefetchQueued = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "webcache_prefetch_queue_length",
+		Help: "Prefetches waiting for a worker.",
+	})
+
+	prefetchRunning = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "webcache_prefetches_in_flight",
+		Help: "Prefetches being run by a worker.",
+	})
+
+	prefetchQueueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "webcache_prefetch_queue_wait_seconds",
+		Help:    "Time prefetches waited for a worker, by priority.",
+		Buckets: latencyBuckets,
+	}, []string{"priority"})
+
+	//Totals behind webcache_byte_hit_ratio
+	hitBytes   uint64
+	totalBytes uint64
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, responseBytesTotal, upstreamDuration, evictionsTotal,
+		diskDuration, journalFsyncDuration, prefetchesTotal, prefetchQueued, prefetchRunning, prefetchQueueWait)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "webcache_byte_hit_ratio",
+		Help: "Fraction of the response body bytes of GET requests that were served from the cache.",
+	}, byteHitRatio))
+}
+
+func byteHitRatio() float64 {
+	total := atomic.LoadUint64(&totalBytes)
+	if total == 0 {
+		return 0
+	}
+	return float64(atomic.LoadUint64(&hitBytes)) / float64(total)
+}
+
+// MetricsHandler serves the metrics of the cache in the Prometheus
+// exposition format.
+func MetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// RegisterCacheMetrics exposes the usage of wc and of dc.
+func RegisterCacheMetrics(wc Cache, dc *DiskCache) error {
+	return prometheus.Register(&cacheCollector{cache: wc, disk: dc})
+}
+
+// Outcome returns the metrics outcome of a request with the given cache
+// status.
+func Outcome(cacheStatus string) string {
+	if cacheStatus == "" {
+		return OutcomeBypass
+	}
+	return strings.ToLower(cacheStatus)
+}
+
+// ObserveRequest records a request served with the given cache status.
+func ObserveRequest(method string, cacheStatus string, bytes int64) {
+	outcome := Outcome(cacheStatus)
+	requestsTotal.WithLabelValues(method, outcome).Inc()
+	responseBytesTotal.WithLabelValues(outcome).Add(float64(bytes))
+	if outcome != OutcomeBypass {
+		atomic.AddUint64(&totalBytes, uint64(bytes))
+		if outcome == OutcomeHit {
+			atomic.AddUint64(&hitBytes, uint64(bytes))
+		}
+	}
+}
+
+// Instrument wraps a handler returning the cache status of each request,
+// like the one HARRecorder.Handler takes, to record its requests.
+func Instrument(handle func(http.ResponseWriter, *http.Request) string) func(http.ResponseWriter, *http.Request) string {
+	return func(w http.ResponseWriter, r *http.Request) string {
+		rw := &recordingResponseWriter{ResponseWriter: w}
+		cacheStatus := handle(rw, r)
+		ObserveRequest(r.Method, cacheStatus, rw.size)
+		return cacheStatus
+	}
+}
+
+// ObserveUpstream records the latency of a request to an origin server.
+func ObserveUpstream(start time.Time) {
+	upstreamDuration.Observe(time.Since(start).Seconds())
+}
+
+// ObservePrefetch records the result of prefetching an embedded resource.
+func ObservePrefetch(result string) {
+	prefetchesTotal.WithLabelValues(result).Inc()
+}
+
+func observeEviction(policy string) {
+	evictionsTotal.WithLabelValues(policy).Inc()
+}
+
+func observeDisk(operation string, start time.Time) {
+	diskDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// cacheCollector reports the usage of a cache when scraped.
+type cacheCollector struct {
+	cache Cache
+	disk  *DiskCache
+}
+
+var (
+	capacityDesc    = prometheus.NewDesc("webcache_capacity_bytes", "Capacity used by cached entries, overhead included.", nil, nil)
+	maxCapacityDesc = prometheus.NewDesc("webcache_max_capacity_bytes", "Capacity of the cache.", nil, nil)
+	pendingDesc     = prometheus.NewDesc("webcache_pending_bytes", "Capacity reserved for entries being saved.", nil, nil)
+	entriesDesc     = prometheus.NewDesc("webcache_entries", "Number of cached entries.", nil, nil)
+	maxEntriesDesc  = prometheus.NewDesc("webcache_max_entries", "Maximum number of cached entries, 0 for no limit.", nil, nil)
+	diskDesc        = prometheus.NewDesc("webcache_disk_bytes", "Bytes of the entries saved to disk, framing included.", nil, nil)
+)
+
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- capacityDesc
+	ch <- maxCapacityDesc
+	ch <- pendingDesc
+	ch <- entriesDesc
+	ch <- maxEntriesDesc
+	ch <- diskDesc
+}
+
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.cache.Stats()
+	ch <- prometheus.MustNewConstMetric(capacityDesc, prometheus.GaugeValue, float64(stats.CurrentCapacity))
+	ch <- prometheus.MustNewConstMetric(maxCapacityDesc, prometheus.GaugeValue, float64(stats.MaxCapacity))
+	ch <- prometheus.MustNewConstMetric(pendingDesc, prometheus.GaugeValue, float64(stats.PendingSet))
+	ch <- prometheus.MustNewConstMetric(entriesDesc, prometheus.GaugeValue, float64(stats.Entries))
+	ch <- prometheus.MustNewConstMetric(maxEntriesDesc, prometheus.GaugeValue, float64(stats.MaxEntries))
+	ch <- prometheus.MustNewConstMetric(diskDesc, prometheus.GaugeValue, float64(c.disk.Usage()))
+}
@@ -0,0 +1,91 @@
+package webcache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func scrape(t *testing.T) string {
+	w := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected metrics to be served, got %d", w.Code)
+	}
+	return w.Body.String()
+}
+
+func Test_Metrics(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "metrics")
+	defer os.RemoveAll(dir)
+	store := NewMemoryStore()
+	dc := NewDiskCache(store, path.Join(dir, "journal.log"), 0)
+	defer dc.Close()
+	wc := NewWebCache(NewLFUPolicy(), 1, 60, 1, nil)
+	if err := RegisterCacheMetrics(wc, dc); err != nil {
+		t.Fatal(err)
+	}
+	evictions := testutil.ToFloat64(evictionsTotal.WithLabelValues(LFU))
+	Admit(wc, dc, "http://a.com/1", Value("1"), "text/plain")
+	Admit(wc, dc, "http://a.com/2", Value("2"), "text/plain")
+
+	handle := Instrument(func(w http.ResponseWriter, r *http.Request) string {
+		switch r.URL.Path {
+		case "/hit":
+			w.Write(make([]byte, 30))
+			return CacheHit
+		case "/miss":
+			w.Write(make([]byte, 10))
+			return CacheMiss
+		case "/expired":
+			return CacheExpired
+		case "/stale":
+			return CacheStale
+		}
+		w.Write(make([]byte, 100))
+		return ""
+	})
+	for _, target := range []string{"http://a.com/hit", "http://a.com/hit", "http://a.com/hit", "http://a.com/miss", "http://a.com/expired", "http://a.com/stale"} {
+		handle(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+	}
+	handle(httptest.NewRecorder(), httptest.NewRequest("POST", "http://a.com/form", nil))
+
+	//Only the entry left after the eviction is on disk
+	b, err := store.Get(Hash("http://a.com/2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := scrape(t)
+	for _, expected := range []string{
+		`webcache_requests_total{method="GET",outcome="hit"} 3`,
+		`webcache_requests_total{method="GET",outcome="miss"} 1`,
+		`webcache_requests_total{method="GET",outcome="expired"} 1`,
+		`webcache_requests_total{method="GET",outcome="stale"} 1`,
+		`webcache_requests_total{method="POST",outcome="bypass"} 1`,
+		`webcache_response_bytes_total{outcome="hit"} 90`,
+		`webcache_byte_hit_ratio 0.9`,
+		`webcache_disk_operation_duration_seconds_count{operation="save"}`,
+		`webcache_disk_operation_duration_seconds_count{operation="delete"}`,
+		`webcache_journal_fsync_duration_seconds_count`,
+		`webcache_entries 1`,
+		`webcache_max_entries 1`,
+		`webcache_capacity_bytes 513`,
+		`webcache_max_capacity_bytes 1e+06`,
+		fmt.Sprintf("webcache_disk_bytes %d", len(b)),
+	} {
+		if !strings.Contains(metrics, expected) {
+			t.Errorf("Expected metrics to contain %s", expected)
+		}
+	}
+	if evicted := testutil.ToFloat64(evictionsTotal.WithLabelValues(LFU)) - evictions; evicted != 1 {
+		t.Errorf("Expected 1 LFU eviction, got %f", evicted)
+	}
+}
@@ -3,12 +3,32 @@ package webcache
 import (
 	"container/heap"
 	"container/list"
-	"log"
+	"errors"
+	"fmt"
+)
+
+const (
+	LRU = "LRU"
+	LFU = "LFU"
 )
 
 type Policy interface {
 	Promote(entry *Entry)
 	Evict() *Entry //Clear size bytes from cache
+	EvictWhere(match func(*Entry) bool) *Entry //Evict the first candidate accepted by match
+	Remove(entry *Entry) //Stop tracking an entry deleted from the cache, if it was not evicted
+	Rank(entry *Entry) int //Number of entries that would be evicted before entry
+}
+
+// NewPolicy creates the replacement policy with the given name, LRU or LFU.
+func NewPolicy(name string) (Policy, error) {
+	switch name {
+	case LRU:
+		return NewLRUPolicy(), nil
+	case LFU:
+		return NewLFUPolicy(), nil
+	}
+	return nil, errors.New(fmt.Sprintf("Invalid cache replacement policy [%s]", name))
 }
 
 type LRUPolicy struct {
@@ -33,14 +53,40 @@ func (l *LRUPolicy) Evict() *Entry {
 	if item == nil { return nil }
 	entry := item.Value.(*Entry)
 	l.entries.Remove(item)
-	log.Printf("LRU - evict %s", entry.Key)
+	entry.element = nil
+	Log(PolicyComponent).Debug("evict", "policy", LRU, "key", entry.Key)
+	observeEviction(LRU)
 	return entry
 }
 
-// *** Doesn't seem like this is being used?
-//func (l *LRUPolicy) Delete(entry *Entry) {
-//	l.entries.Remove(entry.element)
-//}
+func (l *LRUPolicy) EvictWhere(match func(*Entry) bool) *Entry {
+	for item := l.entries.Back(); item != nil; item = item.Prev() {
+		entry := item.Value.(*Entry)
+		if match(entry) {
+			l.entries.Remove(item)
+			entry.element = nil
+			Log(PolicyComponent).Debug("evict", "policy", LRU, "key", entry.Key)
+			observeEviction(LRU)
+			return entry
+		}
+	}
+	return nil
+}
+
+func (l *LRUPolicy) Remove(entry *Entry) {
+	if entry.element != nil {
+		l.entries.Remove(entry.element)
+		entry.element = nil
+	}
+}
+
+func (l *LRUPolicy) Rank(entry *Entry) int {
+	rank := 0
+	for item := l.entries.Back(); item != nil && item != entry.element; item = item.Prev() {
+		rank++
+	}
+	return rank
+}
 
 /////////////
 // LFU
@@ -71,8 +117,41 @@ func (l *LFUPolicy) Promote(entry *Entry)  {
 }
 
 func (l *LFUPolicy) Evict() *Entry {
-	//TODO
+	if l.entries.Len() == 0 { return nil }
 	entry := heap.Pop(l.entries).(*Entry)
-	log.Printf("LFU - evict %s. Frequency is %d", entry.Key, entry.hits)
+	Log(PolicyComponent).Debug("evict", "policy", LFU, "key", entry.Key, "frequency", entry.hits)
+	observeEviction(LFU)
 	return entry
 }
+
+func (l *LFUPolicy) EvictWhere(match func(*Entry) bool) *Entry {
+	var candidate *Entry
+	for _, entry := range *l.entries {
+		if match(entry) && (candidate == nil || entry.Less(candidate)) {
+			candidate = entry
+		}
+	}
+	if candidate == nil {
+		return nil
+	}
+	heap.Remove(l.entries, candidate.index)
+	Log(PolicyComponent).Debug("evict", "policy", LFU, "key", candidate.Key, "frequency", candidate.hits)
+	observeEviction(LFU)
+	return candidate
+}
+
+func (l *LFUPolicy) Remove(entry *Entry) {
+	if entry.index >= 0 && entry.index < l.entries.Len() && (*l.entries)[entry.index] == entry {
+		heap.Remove(l.entries, entry.index)
+	}
+}
+
+func (l *LFUPolicy) Rank(entry *Entry) int {
+	rank := 0
+	for _, other := range *l.entries {
+		if other != entry && other.Less(entry) {
+			rank++
+		}
+	}
+	return rank
+}
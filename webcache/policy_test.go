@@ -6,7 +6,7 @@ import (
 
 func Test_LRU_Promote_Single(t *testing.T) {
 	policy := NewLRUPolicy()
-	entry := NewEntry("testkey", []byte("testvalue"), 0)
+	entry := NewEntry("testkey", &Response{Body: []byte("testvalue")})
 	policy.Promote(entry)
 	head := policy.entries.Front()
 	if entry.Key != head.Value.(*Entry).Key {
@@ -18,8 +18,8 @@ func Test_LRU_Promot_Two(t *testing.T) {
 	policy := NewLRUPolicy()
 	keyA := "keyA"
 	keyB := "keyB"
-	entryA := NewEntry(keyA, []byte(keyA), 0)
-	entryB := NewEntry(keyB, []byte(keyB), 0)
+	entryA := NewEntry(keyA, &Response{Body: []byte(keyA)})
+	entryB := NewEntry(keyB, &Response{Body: []byte(keyB)})
 	policy.Promote(entryA)
 	policy.Promote(entryB)
 	head := policy.entries.Front()
@@ -33,8 +33,8 @@ func Test_LRU_Evict_Single(t *testing.T) {
 	policy := NewLRUPolicy()
 	keyA := "keyA"
 	keyB := "keyB"
-	entryA := NewEntry(keyA, []byte(keyA), 0)
-	entryB := NewEntry(keyB, []byte(keyB), 0)
+	entryA := NewEntry(keyA, &Response{Body: []byte(keyA)})
+	entryB := NewEntry(keyB, &Response{Body: []byte(keyB)})
 	policy.Promote(entryA)
 	policy.Promote(entryB)
 	evicted := policy.Evict()
@@ -54,8 +54,8 @@ func Test_LRU_Promote_Twice(t *testing.T) {
 	policy := NewLRUPolicy()
 	keyA := "keyA"
 	keyB := "keyB"
-	entryA := NewEntry(keyA, []byte(keyA), 0)
-	entryB := NewEntry(keyB, []byte(keyB), 0)
+	entryA := NewEntry(keyA, &Response{Body: []byte(keyA)})
+	entryB := NewEntry(keyB, &Response{Body: []byte(keyB)})
 	policy.Promote(entryA)
 	policy.Promote(entryB)
 	policy.Promote(entryA)
@@ -76,7 +76,7 @@ func Test_LRU_Promote_Twice(t *testing.T) {
 
 func Test_LFU_Promote_Single(t *testing.T) {
 	policy := NewLFUPolicy()
-	entry := NewEntry("testkey", []byte("testvalue"), 0)
+	entry := NewEntry("testkey", &Response{Body: []byte("testvalue")})
 	policy.Promote(entry)
 	head := policy.entries.Pop()
 	headKey := head.(*Entry).Key
@@ -89,8 +89,8 @@ func Test_LFU_Promot_Two(t *testing.T) {
 	policy := NewLFUPolicy()
 	keyA := "keyA"
 	keyB := "keyB"
-	entryA := NewEntry(keyA, []byte(keyA), 0)
-	entryB := NewEntry(keyB, []byte(keyB), 0)
+	entryA := NewEntry(keyA, &Response{Body: []byte(keyA)})
+	entryB := NewEntry(keyB, &Response{Body: []byte(keyB)})
 	policy.Promote(entryA)
 	policy.Promote(entryB)
 	length := policy.entries.Len()
@@ -103,8 +103,8 @@ func Test_LFU_Evict_Single(t *testing.T) {
 	policy := NewLFUPolicy()
 	keyA := "keyA"
 	keyB := "keyB"
-	entryA := NewEntry(keyA, []byte(keyA), 0)
-	entryB := NewEntry(keyB, []byte(keyB), 0)
+	entryA := NewEntry(keyA, &Response{Body: []byte(keyA)})
+	entryB := NewEntry(keyB, &Response{Body: []byte(keyB)})
 	policy.Promote(entryA)
 	policy.Promote(entryB)
 	policy.Promote(entryB)
@@ -119,3 +119,40 @@ func Test_LFU_Evict_Single(t *testing.T) {
 	}
 
 }
+
+func Test_Policy_Remove(t *testing.T) {
+	for _, policy := range []Policy{NewLRUPolicy(), NewLFUPolicy()} {
+		entryA := NewEntry("keyA", &Response{Body: []byte("keyA")})
+		entryB := NewEntry("keyB", &Response{Body: []byte("keyB")})
+		policy.Promote(entryA)
+		policy.Promote(entryB)
+		policy.Remove(entryA)
+		policy.Remove(entryA)
+
+		evicted := policy.EvictWhere(func(*Entry) bool { return true })
+		if evicted != entryB {
+			t.Errorf("Expected %s, got %v", entryB.Key, evicted)
+		}
+		if evicted := policy.EvictWhere(func(*Entry) bool { return true }); evicted != nil {
+			t.Errorf("Expected removed entry not to be evicted, got %s", evicted.Key)
+		}
+	}
+}
+
+func Test_Policy_Rank(t *testing.T) {
+	for _, policy := range []Policy{NewLRUPolicy(), NewLFUPolicy()} {
+		entryA := NewEntry("keyA", &Response{Body: []byte("keyA")})
+		entryB := NewEntry("keyB", &Response{Body: []byte("keyB")})
+		entryC := NewEntry("keyC", &Response{Body: []byte("keyC")})
+		policy.Promote(entryA)
+		policy.Promote(entryB)
+		policy.Promote(entryC)
+		policy.Promote(entryA)
+
+		for expected, entry := range []*Entry{entryB, entryC, entryA} {
+			if rank := policy.Rank(entry); rank != expected {
+				t.Errorf("Expected %s to have rank %d, got %d", entry.Key, expected, rank)
+			}
+		}
+	}
+}
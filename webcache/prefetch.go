@@ -0,0 +1,148 @@
+package webcache
+
+import (
+	"sync"
+	"time"
+)
+
+// PrefetchPriority orders the prefetches waiting in a PrefetchPool.
+type PrefetchPriority int
+
+const (
+	PriorityHigh   PrefetchPriority = iota //Stylesheets and scripts, which block rendering
+	PriorityNormal                         //Other linked resources, such as icons and fonts
+	PriorityLow                            //Images and media
+	numPriorities
+)
+
+var priorityNames = [numPriorities]string{"high", "normal", "low"}
+
+func (p PrefetchPriority) String() string {
+	return priorityNames[p]
+}
+
+const (
+	DefaultPrefetchConcurrency = 32
+	DefaultPrefetchPerHost     = 6
+	DefaultPrefetchQueue       = 1024
+)
+
+// PrefetchPool runs prefetches on a fixed number of workers, running at
+// most perHost of them against the same host. Waiting prefetches are run
+// by priority, then in the order they were submitted. Once maxQueue
+// prefetches are waiting, further ones are rejected.
+type PrefetchPool struct {
+	sync.Mutex
+	cond     *sync.Cond
+	queues   [numPriorities][]*prefetchTask
+	queued   int
+	running  map[string]int //Prefetches running per host
+	perHost  int
+	maxQueue int
+	closed   bool
+	workers  sync.WaitGroup
+}
+
+type prefetchTask struct {
+	host     string
+	priority PrefetchPriority
+	fetch    func()
+	enqueued time.Time
+}
+
+func NewPrefetchPool(concurrency int, perHost int, maxQueue int) *PrefetchPool {
+	p := &PrefetchPool{
+		running:  make(map[string]int),
+		perHost:  perHost,
+		maxQueue: maxQueue,
+	}
+	p.cond = sync.NewCond(&p.Mutex)
+	for i := 0; i < concurrency; i++ {
+		p.workers.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+// Submit queues fetch to prefetch url. It returns false, without running
+// fetch, if the queue is full or the pool is closed.
+func (p *PrefetchPool) Submit(url string, priority PrefetchPriority, fetch func()) bool {
+	p.Lock()
+	defer p.Unlock()
+	if p.closed || (p.maxQueue > 0 && p.queued >= p.maxQueue) {
+		ObservePrefetch(PrefetchRejected)
+		return false
+	}
+	p.queues[priority] = append(p.queues[priority], &prefetchTask{
+		host:     HostOf(url),
+		priority: priority,
+		fetch:    fetch,
+		enqueued: time.Now(),
+	})
+	p.queued++
+	prefetchQueued.Inc()
+	p.cond.Signal()
+	return true
+}
+
+// Close stops accepting prefetches and returns once the queued ones have
+// run.
+func (p *PrefetchPool) Close() {
+	p.Lock()
+	p.closed = true
+	p.cond.Broadcast()
+	p.Unlock()
+	p.workers.Wait()
+}
+
+func (p *PrefetchPool) work() {
+	defer p.workers.Done()
+	for {
+		p.Lock()
+		task := p.next()
+		for task == nil {
+			if p.closed && p.queued == 0 {
+				p.Unlock()
+				return
+			}
+			p.cond.Wait()
+			task = p.next()
+		}
+		p.running[task.host]++
+		p.Unlock()
+
+		prefetchQueueWait.WithLabelValues(task.priority.String()).Observe(time.Since(task.enqueued).Seconds())
+		prefetchRunning.Inc()
+		task.fetch()
+		prefetchRunning.Dec()
+
+		p.Lock()
+		p.running[task.host]--
+		if p.running[task.host] == 0 {
+			delete(p.running, task.host)
+		}
+		//Prefetches of the host may have been waiting for this one
+		p.cond.Broadcast()
+		p.Unlock()
+	}
+}
+
+// next removes and returns the first queued prefetch, by priority, whose
+// host is below its limit, or nil if there is none.
+func (p *PrefetchPool) next() *prefetchTask {
+	for priority := range p.queues {
+		queue := p.queues[priority]
+		for i, task := range queue {
+			if p.perHost > 0 && p.running[task.host] >= p.perHost {
+				continue
+			}
+			copy(queue[i:], queue[i+1:])
+			queue[len(queue)-1] = nil
+			p.queues[priority] = queue[:len(queue)-1]
+			p.queued--
+			prefetchQueued.Dec()
+			return task
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package webcache
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_PrefetchPool_Priority(t *testing.T) {
+	pool := NewPrefetchPool(1, 0, 0)
+	release := make(chan struct{})
+	pool.Submit("http://a.com/page", PriorityLow, func() { <-release })
+
+	var lock sync.Mutex
+	var order []string
+	for _, r := range []struct {
+		url      string
+		priority PrefetchPriority
+	}{
+		{"http://a.com/1.png", PriorityLow},
+		{"http://a.com/icon.ico", PriorityNormal},
+		{"http://a.com/style.css", PriorityHigh},
+		{"http://a.com/2.png", PriorityLow},
+		{"http://a.com/app.js", PriorityHigh},
+	} {
+		url := r.url
+		pool.Submit(url, r.priority, func() {
+			lock.Lock()
+			order = append(order, url)
+			lock.Unlock()
+		})
+	}
+	close(release)
+	pool.Close()
+
+	expected := []string{"http://a.com/style.css", "http://a.com/app.js", "http://a.com/icon.ico", "http://a.com/1.png", "http://a.com/2.png"}
+	if len(order) != len(expected) {
+		t.Fatalf("Expected %d prefetches, got %v", len(expected), order)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Errorf("Expected prefetches in order %v, got %v", expected, order)
+			break
+		}
+	}
+}
+
+func Test_PrefetchPool_Per_Host(t *testing.T) {
+	pool := NewPrefetchPool(8, 2, 0)
+	var lock sync.Mutex
+	running := make(map[string]int)
+	maxRunning := make(map[string]int)
+	var total, maxTotal int32
+	for i := 0; i < 20; i++ {
+		host := []string{"a.com", "b.com"}[i%2]
+		pool.Submit("http://"+host+"/resource", PriorityNormal, func() {
+			n := atomic.AddInt32(&total, 1)
+			lock.Lock()
+			if n > maxTotal {
+				maxTotal = n
+			}
+			running[host]++
+			if running[host] > maxRunning[host] {
+				maxRunning[host] = running[host]
+			}
+			lock.Unlock()
+
+			time.Sleep(5 * time.Millisecond)
+
+			lock.Lock()
+			running[host]--
+			lock.Unlock()
+			atomic.AddInt32(&total, -1)
+		})
+	}
+	pool.Close()
+
+	for _, host := range []string{"a.com", "b.com"} {
+		if maxRunning[host] != 2 {
+			t.Errorf("Expected at most 2 prefetches at once from %s, got %d", host, maxRunning[host])
+		}
+	}
+	if maxTotal > 4 {
+		t.Errorf("Expected at most 4 prefetches at once from 2 hosts, got %d", maxTotal)
+	}
+}
+
+func Test_PrefetchPool_Queue_Full(t *testing.T) {
+	pool := NewPrefetchPool(1, 0, 2)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	pool.Submit("http://a.com/1.js", PriorityHigh, func() {
+		close(started)
+		<-release
+	})
+	<-started
+
+	var ran int32
+	count := func() { atomic.AddInt32(&ran, 1) }
+	if !pool.Submit("http://a.com/2.js", PriorityHigh, count) || !pool.Submit("http://a.com/3.js", PriorityHigh, count) {
+		t.Errorf("Expected prefetches to be queued below the limit")
+	}
+	if pool.Submit("http://a.com/4.js", PriorityHigh, count) {
+		t.Errorf("Expected a prefetch to be rejected once the queue is full")
+	}
+	close(release)
+	pool.Close()
+
+	if ran != 2 {
+		t.Errorf("Expected the 2 queued prefetches to run before Close returned, got %d", ran)
+	}
+	if pool.Submit("http://a.com/5.js", PriorityHigh, count) {
+		t.Errorf("Expected prefetches to be rejected once the pool is closed")
+	}
+}
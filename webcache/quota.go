@@ -0,0 +1,154 @@
+package webcache
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type QuotaKind int
+
+const (
+	QuotaHost QuotaKind = iota
+	QuotaHostSuffix
+	QuotaContentType
+)
+
+var quotaKindNames = map[QuotaKind]string{
+	QuotaHost:        "host",
+	QuotaHostSuffix:  "suffix",
+	QuotaContentType: "type",
+}
+
+// Quota caps the share of the cache capacity that entries belonging to a
+// partition (a host, a host suffix or a content type) may use.
+type Quota struct {
+	Kind    QuotaKind
+	Pattern string
+	Ratio   float64
+}
+
+// ParseQuota parses a quota rule of the form kind:pattern=limit, e.g.
+// "host:example.com=25%", "suffix:.cdn.net=0.1" or "type:video/*=30%".
+func ParseQuota(rule string) (Quota, error) {
+	var q Quota
+	kind, pattern, limit, err := parseRule("quota", rule)
+	if err != nil {
+		return q, err
+	}
+	q.Kind = kind
+	q.Pattern = pattern
+
+	percent := strings.HasSuffix(limit, "%")
+	ratio, err := strconv.ParseFloat(strings.TrimSuffix(limit, "%"), 64)
+	if err != nil {
+		return q, errors.New(fmt.Sprintf("Invalid quota limit [%s]", limit))
+	}
+	if percent {
+		ratio /= 100
+	}
+	if ratio <= 0 || ratio > 1 {
+		return q, errors.New(fmt.Sprintf("Quota limit [%s] must be within (0, 100%%]", limit))
+	}
+	q.Ratio = ratio
+	return q, nil
+}
+
+// parseRule splits a rule of the form kind:pattern=value applying to a
+// partition of the cache, as used by quotas and TTL rules.
+func parseRule(name string, rule string) (kind QuotaKind, pattern string, value string, err error) {
+	sep := strings.Index(rule, ":")
+	eq := strings.LastIndex(rule, "=")
+	if sep < 0 || eq < sep {
+		return kind, pattern, value, errors.New(fmt.Sprintf("Invalid %s rule [%s]", name, rule))
+	}
+
+	found := false
+	for k, kindName := range quotaKindNames {
+		if kindName == rule[:sep] {
+			kind = k
+			found = true
+		}
+	}
+	if !found {
+		return kind, pattern, value, errors.New(fmt.Sprintf("Invalid %s kind [%s]", name, rule[:sep]))
+	}
+
+	pattern = strings.ToLower(rule[sep+1 : eq])
+	if pattern == "" {
+		return kind, pattern, value, errors.New(fmt.Sprintf("Missing %s pattern in [%s]", name, rule))
+	}
+	return kind, pattern, rule[eq+1:], nil
+}
+
+func (q Quota) String() string {
+	return fmt.Sprintf("%s:%s=%g%%", quotaKindNames[q.Kind], q.Pattern, q.Ratio*100)
+}
+
+// Limit returns the number of bytes the quota allows out of maxCapacity.
+func (q Quota) Limit(maxCapacity int) int {
+	return int(float64(maxCapacity) * q.Ratio)
+}
+
+// Matches reports whether a response for url with the given content type
+// falls in the quota's partition.
+func (q Quota) Matches(url string, contentType string) bool {
+	return matchesPartition(q.Kind, q.Pattern, url, contentType)
+}
+
+func matchesPartition(kind QuotaKind, pattern string, url string, contentType string) bool {
+	switch kind {
+	case QuotaHost:
+		return HostOf(url) == pattern
+	case QuotaHostSuffix:
+		host := HostOf(url)
+		return host == strings.TrimPrefix(pattern, ".") || strings.HasSuffix(host, "."+strings.TrimPrefix(pattern, "."))
+	case QuotaContentType:
+		mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+		if strings.HasSuffix(pattern, "/*") {
+			return strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*"))
+		}
+		return mediaType == pattern
+	}
+	return false
+}
+
+// HostOf returns the lower-cased host of url without port. url may omit
+// the scheme.
+func HostOf(url string) string {
+	host := url
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	if i := strings.IndexAny(host, "/?#"); i >= 0 {
+		host = host[:i]
+	}
+	if strings.HasPrefix(host, "[") {
+		if i := strings.Index(host, "]"); i >= 0 {
+			host = host[1:i]
+		}
+	} else if i := strings.LastIndex(host, ":"); i >= 0 {
+		host = host[:i]
+	}
+	return strings.ToLower(host)
+}
+
+type quotaUsage struct {
+	Quota
+	current int
+	pending int
+}
+
+// release frees capacity reserved for an entry that has been set. Quotas
+// replaced while the entry was being saved did not reserve it.
+func (q *quotaUsage) release(size int) {
+	q.pending -= size
+	if q.pending < 0 {
+		q.pending = 0
+	}
+}
+
+func (q *quotaUsage) matchesEntry(entry *Entry) bool {
+	return q.Matches(entry.URL, entry.ContentType)
+}
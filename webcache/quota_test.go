@@ -0,0 +1,110 @@
+package webcache
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_Quota_Parse(t *testing.T) {
+	quota, err := ParseQuota("type:video/*=30%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quota.Kind != QuotaContentType || quota.Pattern != "video/*" || quota.Ratio != 0.3 {
+		t.Errorf("Expected type:video/*=30%%, got %s", quota)
+	}
+
+	for _, rule := range []string{"video/*=30%", "type:video/*", "colour:red=10%", "host:a.com=0", "host:a.com=150%"} {
+		if _, err := ParseQuota(rule); err == nil {
+			t.Errorf("Expected error parsing %s", rule)
+		}
+	}
+}
+
+func Test_Quota_Matches(t *testing.T) {
+	host, _ := ParseQuota("host:example.com=10%")
+	suffix, _ := ParseQuota("suffix:.example.com=10%")
+	video, _ := ParseQuota("type:video/*=10%")
+
+	if !host.Matches("http://Example.com:8080/a.png", "image/png") {
+		t.Errorf("Expected %s to match host", host)
+	}
+	if host.Matches("http://cdn.example.com/a.png", "image/png") {
+		t.Errorf("Expected %s not to match subdomain", host)
+	}
+	if !suffix.Matches("cdn.example.com/a.png", "") || !suffix.Matches("example.com/", "") {
+		t.Errorf("Expected %s to match host and subdomain", suffix)
+	}
+	if suffix.Matches("http://badexample.com/", "") {
+		t.Errorf("Expected %s not to match badexample.com", suffix)
+	}
+	if !video.Matches("http://a.com/v", "video/mp4; codecs=avc1") || video.Matches("http://a.com/v", "image/png") {
+		t.Errorf("Expected %s to match only video content", video)
+	}
+}
+
+func Test_Quota_Evicts_Within_Partition(t *testing.T) {
+	video, _ := ParseQuota("type:video/*=50%")
+	c := NewWebCache(NewLRUPolicy(), 1, 60, 0, []Quota{video}).(*WebCache)
+	c.maxCapacity = 10 * EntryOverhead
+
+	set := func(url string, size int, contentType string) {
+		body := make(Value, size)
+		toDelete, ok := c.FindEvictionEntries(url, body, contentType)
+		for _, key := range toDelete {
+			c.Delete(key)
+		}
+		if ok {
+			c.Set(url, &Response{URL: url, Body: body, ContentType: contentType, ExpirationTime: time.Now().Add(time.Minute)})
+		}
+	}
+
+	set("http://a.com/v1", 1000, "video/mp4")
+	set("http://a.com/page", 500, "text/html")
+	set("http://a.com/v2", 1000, "video/mp4")
+
+	if _, ok := c.cache[Hash("http://a.com/v1")]; ok {
+		t.Errorf("Expected oldest video to be evicted")
+	}
+	if _, ok := c.cache[Hash("http://a.com/page")]; !ok {
+		t.Errorf("Expected page outside the video quota to stay cached")
+	}
+	videoSize, pageSize := EntrySize(make(Value, 1000)), EntrySize(make(Value, 500))
+	if c.quotas[0].current != videoSize || c.currentCapacity != videoSize+pageSize {
+		t.Errorf("Expected %d bytes of video and %d bytes total, got %d and %d", videoSize, videoSize+pageSize, c.quotas[0].current, c.currentCapacity)
+	}
+
+	if _, ok := c.FindEvictionEntries("http://a.com/v3", make(Value, 3000), "video/mp4"); ok {
+		t.Errorf("Expected response larger than quota not to be cached")
+	}
+}
+
+func Test_Quota_Set_Quotas(t *testing.T) {
+	c := NewWebCache(NewLRUPolicy(), 1, 60, 0, nil).(*WebCache)
+	for _, url := range []string{"http://a.com/v", "http://b.com/v"} {
+		c.FindEvictionEntries(url, make(Value, 1000), "video/mp4")
+		c.Set(url, &Response{URL: url, Body: make(Value, 1000), ContentType: "video/mp4", ExpirationTime: time.Now().Add(time.Minute)})
+	}
+
+	host, _ := ParseQuota("host:a.com=10%")
+	c.SetQuotas([]Quota{host})
+	if len(c.quotas) != 1 || c.quotas[0].current != EntrySize(make(Value, 1000)) {
+		t.Fatalf("Expected the usage of %s to be recomputed", host)
+	}
+
+	//Capacity reserved before the quotas changed must not leave them negative
+	c.FindEvictionEntries("http://c.com/v", make(Value, 10), "video/mp4")
+	c.SetQuotas([]Quota{host, video(t)})
+	c.Set("http://c.com/v", &Response{URL: "http://c.com/v", Body: make(Value, 10), ContentType: "video/mp4"})
+	if c.quotas[1].pending != 0 {
+		t.Errorf("Expected no pending bytes, got %d", c.quotas[1].pending)
+	}
+}
+
+func video(t *testing.T) Quota {
+	q, err := ParseQuota("type:video/*=50%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
@@ -0,0 +1,315 @@
+package webcache
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// EmbeddedURL is the resolved URL of a resource embedded in an HTML page.
+// Documents, the pages of frames and refreshes, are rewritten so that the
+// proxy rewrites them in turn when they are requested, and should not be
+// prefetched.
+type EmbeddedURL struct {
+	URL      string
+	Priority PrefetchPriority
+	Document bool
+}
+
+// Kinds of attribute values holding URLs.
+const (
+	urlValue     = iota //A single URL
+	srcsetValue         //A srcset list of image candidates
+	refreshValue        //The content of a meta refresh, a delay and a URL
+)
+
+// rewriteAttr is an attribute of an element holding URLs to rewrite, when
+// the element is accepted by when.
+type rewriteAttr struct {
+	tag      string
+	attr     string
+	kind     int
+	priority PrefetchPriority
+	document bool
+	when     func(*html.Node) bool
+}
+
+// The sizes attribute of img and source only holds lengths, the width
+// descriptors of srcset it refers to are kept by the rewriting.
+var rewriteAttrs = []rewriteAttr{
+	{tag: "script", attr: "src", priority: PriorityHigh},
+	{tag: "link", attr: "href", priority: PriorityHigh, when: isStylesheet},
+	{tag: "link", attr: "href", priority: PriorityNormal},
+	{tag: "img", attr: "src", priority: PriorityLow},
+	{tag: "img", attr: "srcset", kind: srcsetValue, priority: PriorityLow},
+	{tag: "source", attr: "src", priority: PriorityLow},
+	{tag: "source", attr: "srcset", kind: srcsetValue, priority: PriorityLow},
+	{tag: "video", attr: "src", priority: PriorityLow},
+	{tag: "video", attr: "poster", priority: PriorityLow},
+	{tag: "audio", attr: "src", priority: PriorityLow},
+	{tag: "input", attr: "src", priority: PriorityLow, when: isImageInput},
+	{tag: "object", attr: "data", priority: PriorityNormal},
+	{tag: "embed", attr: "src", priority: PriorityNormal},
+	{tag: "iframe", attr: "src", document: true},
+	{tag: "meta", attr: "content", kind: refreshValue, document: true, when: isRefresh},
+}
+
+// RewriteHTML parses the HTML page at pageURL from r and replaces the URLs
+// of the resources it embeds by what rewrite returns for them, leaving
+// those it returns false for as they are. Relative URLs are resolved
+// against pageURL, or the first <base href> of the page wherever it is.
+func RewriteHTML(pageURL string, r io.Reader, rewrite func(EmbeddedURL) (string, bool)) ([]byte, error) {
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := html.Parse(r)
+	if err != nil {
+		return nil, errors.New("problem parsing html")
+	}
+
+	//The base applies to the whole document, URLs before it included
+	if ref := findBase(doc); ref != nil {
+		base = base.ResolveReference(ref)
+	}
+	var f func(*html.Node)
+	f = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			for i, a := range n.Attr {
+				rule := findRewriteAttr(n, a.Key)
+				if rule == nil {
+					continue
+				}
+				replace := func(ref string) string {
+					resolved, ok := ResolveURL(base, ref)
+					if !ok {
+						return ref
+					}
+					rewritten, ok := rewrite(EmbeddedURL{URL: resolved, Priority: rule.priority, Document: rule.document})
+					if !ok {
+						return ref
+					}
+					return rewritten
+				}
+				switch rule.kind {
+				case urlValue:
+					n.Attr[i].Val = replace(a.Val)
+				case srcsetValue:
+					n.Attr[i].Val = rewriteSrcset(a.Val, replace)
+				case refreshValue:
+					n.Attr[i].Val = rewriteRefresh(a.Val, replace)
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			f(c)
+		}
+	}
+	f(doc)
+
+	var buf bytes.Buffer
+	err = html.Render(&buf, doc)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// findBase returns the href of the first <base> element of doc with a valid
+// one, or nil if there is none.
+func findBase(n *html.Node) *url.URL {
+	if n.Type == html.ElementNode && n.Data == "base" {
+		if href, ok := attrValue(n, "href"); ok {
+			if ref, err := url.Parse(strings.TrimSpace(href)); err == nil {
+				return ref
+			}
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if ref := findBase(c); ref != nil {
+			return ref
+		}
+	}
+	return nil
+}
+
+func findRewriteAttr(n *html.Node, attr string) *rewriteAttr {
+	for i := range rewriteAttrs {
+		rule := &rewriteAttrs[i]
+		if rule.tag == n.Data && rule.attr == attr && (rule.when == nil || rule.when(n)) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func attrValue(n *html.Node, key string) (string, bool) {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+func isStylesheet(n *html.Node) bool {
+	rel, _ := attrValue(n, "rel")
+	for _, value := range strings.Fields(strings.ToLower(rel)) {
+		if value == "stylesheet" {
+			return true
+		}
+	}
+	return false
+}
+
+func isImageInput(n *html.Node) bool {
+	t, _ := attrValue(n, "type")
+	return strings.EqualFold(strings.TrimSpace(t), "image")
+}
+
+func isRefresh(n *html.Node) bool {
+	equiv, _ := attrValue(n, "http-equiv")
+	return strings.EqualFold(strings.TrimSpace(equiv), "refresh")
+}
+
+// ResolveURL resolves ref, a URL embedded in an HTML page, against base,
+// the URL of the page or of its <base href> element. Relative and
+// protocol-relative URLs are made absolute. It returns false for URLs the
+// proxy cannot fetch: empty ones, fragments of the page and schemes other
+// than http.
+func ResolveURL(base *url.URL, ref string) (string, bool) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(ref, "#") {
+		return "", false
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return "", false
+	}
+	resolved := base.ResolveReference(u)
+	if resolved.Scheme != "http" || resolved.Host == "" {
+		return "", false
+	}
+	//The fragment is never sent to the origin server
+	resolved.Fragment = ""
+	return resolved.String(), true
+}
+
+// srcsetCandidate is an image candidate of a srcset attribute, its URL and
+// its width or density descriptor, if any.
+type srcsetCandidate struct {
+	URL        string
+	Descriptor string
+}
+
+// parseSrcset splits a srcset attribute into its image candidates, following
+// the HTML parsing rules: URLs run up to the next whitespace and may contain
+// commas, except trailing ones, which end the candidate.
+func parseSrcset(srcset string) []srcsetCandidate {
+	var candidates []srcsetCandidate
+	i := 0
+	for {
+		for i < len(srcset) && (isHTMLSpace(srcset[i]) || srcset[i] == ',') {
+			i++
+		}
+		if i >= len(srcset) {
+			return candidates
+		}
+		start := i
+		for i < len(srcset) && !isHTMLSpace(srcset[i]) {
+			i++
+		}
+		candidate := srcsetCandidate{URL: srcset[start:i]}
+		if strings.HasSuffix(candidate.URL, ",") {
+			candidate.URL = strings.TrimRight(candidate.URL, ",")
+		} else {
+			//Descriptors run up to the next comma outside parentheses
+			start = i
+			depth := 0
+			for i < len(srcset) && (srcset[i] != ',' || depth > 0) {
+				if srcset[i] == '(' {
+					depth++
+				} else if srcset[i] == ')' && depth > 0 {
+					depth--
+				}
+				i++
+			}
+			candidate.Descriptor = strings.Join(strings.Fields(srcset[start:i]), " ")
+		}
+		if candidate.URL != "" {
+			candidates = append(candidates, candidate)
+		}
+	}
+}
+
+func rewriteSrcset(srcset string, replace func(string) string) string {
+	candidates := parseSrcset(srcset)
+	parts := make([]string, len(candidates))
+	for i, c := range candidates {
+		parts[i] = replace(c.URL)
+		if c.Descriptor != "" {
+			parts[i] += " " + c.Descriptor
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// splitRefresh splits the content of a meta refresh, such as
+// "5; url='/next'", around its URL. ok is false if it holds no URL.
+func splitRefresh(content string) (before string, ref string, after string, ok bool) {
+	i := 0
+	for i < len(content) && (isHTMLSpace(content[i]) || content[i] == '.' || (content[i] >= '0' && content[i] <= '9')) {
+		i++
+	}
+	if i < len(content) && (content[i] == ';' || content[i] == ',') {
+		i++
+	}
+	for i < len(content) && isHTMLSpace(content[i]) {
+		i++
+	}
+	if i >= len(content) {
+		return content, "", "", false
+	}
+	if len(content)-i >= 3 && strings.EqualFold(content[i:i+3], "url") {
+		j := i + 3
+		for j < len(content) && isHTMLSpace(content[j]) {
+			j++
+		}
+		if j < len(content) && content[j] == '=' {
+			j++
+			for j < len(content) && isHTMLSpace(content[j]) {
+				j++
+			}
+			i = j
+		}
+	}
+	end := len(content)
+	if i < len(content) && (content[i] == '\'' || content[i] == '"') {
+		quote := content[i]
+		i++
+		if k := strings.IndexByte(content[i:], quote); k >= 0 {
+			end = i + k
+		}
+	}
+	ref = strings.TrimRight(content[i:end], " \t\n\f\r")
+	if ref == "" {
+		return content, "", "", false
+	}
+	return content[:i], ref, content[i+len(ref):], true
+}
+
+func rewriteRefresh(content string, replace func(string) string) string {
+	before, ref, after, ok := splitRefresh(content)
+	if !ok {
+		return content
+	}
+	return before + replace(ref) + after
+}
+
+func isHTMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\f' || c == '\r'
+}
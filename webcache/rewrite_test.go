@@ -0,0 +1,147 @@
+package webcache
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "Rewrite the golden files of the tests")
+
+func Test_Rewrite_Resolve_URL(t *testing.T) {
+	base, _ := url.Parse("http://a.com/blog/post.html")
+	for _, test := range []struct {
+		ref      string
+		resolved string
+		ok       bool
+	}{
+		{"http://b.com/x.js", "http://b.com/x.js", true},
+		{"/img/a.png", "http://a.com/img/a.png", true},
+		{"../style.css", "http://a.com/style.css", true},
+		{"images/b.png", "http://a.com/blog/images/b.png", true},
+		{"//cdn.example.com/x.js", "http://cdn.example.com/x.js", true},
+		{" logo.png#top ", "http://a.com/blog/logo.png", true},
+		{"?page=2", "http://a.com/blog/post.html?page=2", true},
+		{"https://b.com/x.js", "", false},
+		{"data:image/png;base64,AAAA", "", false},
+		{"javascript:void(0)", "", false},
+		{"#section", "", false},
+		{"", "", false},
+	} {
+		resolved, ok := ResolveURL(base, test.ref)
+		if resolved != test.resolved || ok != test.ok {
+			t.Errorf("Expected %q to resolve to %q, %v, got %q, %v", test.ref, test.resolved, test.ok, resolved, ok)
+		}
+	}
+
+	//A <base href> may itself be relative to the page
+	cdn, _ := url.Parse("//cdn.a.com/assets/")
+	base = base.ResolveReference(cdn)
+	resolved, _ := ResolveURL(base, "app.js")
+	if resolved != "http://cdn.a.com/assets/app.js" {
+		t.Errorf("Expected http://cdn.a.com/assets/app.js, got %s", resolved)
+	}
+}
+
+func Test_Rewrite_Parse_Srcset(t *testing.T) {
+	for _, test := range []struct {
+		srcset     string
+		candidates []srcsetCandidate
+	}{
+		{"a.png", []srcsetCandidate{{"a.png", ""}}},
+		{"a.png 1x, b.png 2x", []srcsetCandidate{{"a.png", "1x"}, {"b.png", "2x"}}},
+		{" a.png  480w ,\n b.png\t800w ", []srcsetCandidate{{"a.png", "480w"}, {"b.png", "800w"}}},
+		{"a.png,b.png 2x", []srcsetCandidate{{"a.png,b.png", "2x"}}},
+		{"a.png,, b.png 2x", []srcsetCandidate{{"a.png", ""}, {"b.png", "2x"}}},
+		{"data:image/png;base64,AA== 1x", []srcsetCandidate{{"data:image/png;base64,AA==", "1x"}}},
+		{"a.png (future, descriptor), b.png", []srcsetCandidate{{"a.png", "(future, descriptor)"}, {"b.png", ""}}},
+		{" , ", nil},
+	} {
+		candidates := parseSrcset(test.srcset)
+		if !reflect.DeepEqual(candidates, test.candidates) {
+			t.Errorf("Expected %q to be parsed as %v, got %v", test.srcset, test.candidates, candidates)
+		}
+	}
+}
+
+func Test_Rewrite_Split_Refresh(t *testing.T) {
+	for _, test := range []struct {
+		content string
+		ref     string
+		ok      bool
+	}{
+		{"5; url=next.html", "next.html", true},
+		{"0;URL='/moved'", "/moved", true},
+		{"3, http://a.com/x", "http://a.com/x", true},
+		{"1; url = \"q.html\" trailing", "q.html", true},
+		{"1; next.html ", "next.html", true},
+		{"10", "", false},
+		{"10; url=", "", false},
+	} {
+		before, ref, after, ok := splitRefresh(test.content)
+		if ref != test.ref || ok != test.ok {
+			t.Errorf("Expected %q to refresh to %q, %v, got %q, %v", test.content, test.ref, test.ok, ref, ok)
+		}
+		if ok && before+ref+after != test.content {
+			t.Errorf("Expected %q to be split around its URL, got %q %q %q", test.content, before, ref, after)
+		}
+	}
+}
+
+// Test_Rewrite_Golden rewrites the pages of testdata/rewrite and compares
+// them, and the URLs passed to the rewrite function, with the golden files
+// next to them. go test -run Rewrite_Golden -update rewrites the golden
+// files.
+func Test_Rewrite_Golden(t *testing.T) {
+	pages, err := filepath.Glob(filepath.Join("testdata", "rewrite", "*.html"))
+	if err != nil || len(pages) == 0 {
+		t.Fatalf("Expected sample pages in testdata/rewrite, got %v", err)
+	}
+	for _, page := range pages {
+		file, err := os.Open(page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var urls []string
+		rewritten, err := RewriteHTML("http://example.com/blog/post.html", file, func(embedded EmbeddedURL) (string, bool) {
+			if embedded.Document {
+				urls = append(urls, fmt.Sprintf("document %s", embedded.URL))
+			} else {
+				urls = append(urls, fmt.Sprintf("%s %s", embedded.Priority, embedded.URL))
+			}
+			return "http://proxy/" + strings.TrimPrefix(embedded.URL, "http://"), true
+		})
+		file.Close()
+		if err != nil {
+			t.Errorf("Expected %s to be rewritten, got %s", page, err)
+			continue
+		}
+
+		name := strings.TrimSuffix(page, ".html")
+		compareGolden(t, name+".golden", rewritten)
+		compareGolden(t, name+".urls", []byte(strings.Join(urls, "\n")+"\n"))
+	}
+}
+
+func compareGolden(t *testing.T, golden string, actual []byte) {
+	if *update {
+		err := ioutil.WriteFile(golden, actual, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(expected) != string(actual) {
+		t.Errorf("Expected %s:\n%s\ngot:\n%s", golden, expected, actual)
+	}
+}
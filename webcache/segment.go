@@ -0,0 +1,463 @@
+package webcache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSegmentSize        = 64 << 20
+	DefaultCompactionInterval = time.Minute
+	DefaultCompactionRatio    = 0.5
+
+	segmentSuffix     = ".seg"
+	segmentHeaderSize = 13 //crc(4) kind(1) key length(4) value length(4)
+
+	segmentPut       byte = 1
+	segmentTombstone byte = 2
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var errCorruptRecord = errors.New("corrupt segment record")
+
+// ErrCorruptSegment is returned when a sealed segment, one that is no longer
+// appended to, holds a corrupt record. Only the active segment can have a
+// torn tail, so the segment is left as it is for inspection.
+var ErrCorruptSegment = errors.New("corrupt record in a sealed segment")
+
+// SegmentStore appends entries to large segment files and keeps an in-memory
+// index of where the latest version of every key lives. Deletions are
+// recorded as tombstones, and segments whose records are mostly dead are
+// rewritten by a background compaction so the space can be reclaimed.
+type SegmentStore struct {
+	Dir             string
+	MaxSegmentSize  int64
+	CompactionRatio float64 //Fraction of dead bytes at which a segment is compacted
+	sync.Mutex
+	segments map[uint64]*segment
+	active   *segment
+	index    map[string]segmentLocation
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+type segment struct {
+	id   uint64
+	file *os.File
+	size int64
+	dead int64
+}
+
+type segmentLocation struct {
+	segment uint64
+	offset  int64
+	length  int64
+}
+
+type segmentRecord struct {
+	kind  byte
+	key   string
+	value []byte
+}
+
+// NewSegmentStore opens the segments in dir, rebuilding the index from them,
+// and starts compacting every compactionInterval.
+func NewSegmentStore(dir string, maxSegmentSize int64, compactionInterval time.Duration) (*SegmentStore, error) {
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	s := &SegmentStore{
+		Dir:             dir,
+		MaxSegmentSize:  maxSegmentSize,
+		CompactionRatio: DefaultCompactionRatio,
+		segments:        make(map[uint64]*segment),
+		index:           make(map[string]segmentLocation),
+		stop:            make(chan struct{}),
+		stopped:         make(chan struct{}),
+	}
+	err = s.load()
+	if err != nil {
+		s.closeSegments()
+		return nil, err
+	}
+
+	go s.runCompaction(compactionInterval)
+	return s, nil
+}
+
+func (s *SegmentStore) load() error {
+	files, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return err
+	}
+	var ids []uint64
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), segmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), segmentSuffix), 16, 64)
+		if err != nil {
+			Log(StoreComponent).Warn("ignoring unknown file in segment store", "file", f.Name())
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for i, id := range ids {
+		seg, err := s.openSegment(id)
+		if err != nil {
+			return err
+		}
+		err = s.replay(seg, i < len(ids)-1)
+		if err != nil {
+			return err
+		}
+		s.active = seg
+	}
+	if s.active == nil || s.active.size >= s.MaxSegmentSize {
+		return s.roll()
+	}
+	return nil
+}
+
+// replay adds the records of seg to the index. A torn or corrupt record ends
+// the last segment, and everything from it onwards is truncated. Sealed
+// segments were synced before the next one was created, so a corrupt record
+// in them is reported as ErrCorruptSegment.
+func (s *SegmentStore) replay(seg *segment, sealed bool) error {
+	reader := bufio.NewReader(io.NewSectionReader(seg.file, 0, seg.size))
+	var offset int64
+	for {
+		record, length, err := readSegmentRecord(reader, seg.size-offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && sealed {
+			Log(StoreComponent).Error("corrupt record in sealed segment", "file", seg.file.Name(), "offset", offset, "error", err)
+			return ErrCorruptSegment
+		}
+		if err != nil {
+			Log(StoreComponent).Warn("truncating segment after a torn or corrupt record", "file", seg.file.Name(), "offset", offset, "error", err)
+			err = seg.file.Truncate(offset)
+			if err != nil {
+				return err
+			}
+			seg.size = offset
+			break
+		}
+		s.apply(seg, record, segmentLocation{segment: seg.id, offset: offset, length: length})
+		offset += length
+	}
+	return nil
+}
+
+func (s *SegmentStore) apply(seg *segment, record *segmentRecord, loc segmentLocation) {
+	if old, ok := s.index[record.key]; ok {
+		s.segments[old.segment].dead += old.length
+	}
+	switch record.kind {
+	case segmentPut:
+		s.index[record.key] = loc
+	case segmentTombstone:
+		delete(s.index, record.key)
+		seg.dead += loc.length
+	}
+}
+
+func (s *SegmentStore) Put(key string, value []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	loc, err := s.append(&segmentRecord{kind: segmentPut, key: key, value: value}, true)
+	if err != nil {
+		return err
+	}
+	s.apply(s.active, &segmentRecord{kind: segmentPut, key: key}, loc)
+	return nil
+}
+
+func (s *SegmentStore) Get(key string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	loc, ok := s.index[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	buf := make([]byte, loc.length)
+	_, err := s.segments[loc.segment].file.ReadAt(buf, loc.offset)
+	if err != nil {
+		return nil, err
+	}
+	record, _, err := readSegmentRecord(bufio.NewReader(bytes.NewReader(buf)), loc.length)
+	if err != nil {
+		return nil, err
+	}
+	return record.value, nil
+}
+
+func (s *SegmentStore) Delete(key string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.index[key]; !ok {
+		return nil
+	}
+	loc, err := s.append(&segmentRecord{kind: segmentTombstone, key: key}, true)
+	if err != nil {
+		return err
+	}
+	s.apply(s.active, &segmentRecord{kind: segmentTombstone, key: key}, loc)
+	return nil
+}
+
+func (s *SegmentStore) Iterate(fn func(key string) error) error {
+	s.Lock()
+	keys := make([]string, 0, len(s.index))
+	for key := range s.index {
+		keys = append(keys, key)
+	}
+	s.Unlock()
+
+	for _, key := range keys {
+		err := fn(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SegmentStore) Close() error {
+	close(s.stop)
+	<-s.stopped
+
+	s.Lock()
+	defer s.Unlock()
+	return s.closeSegments()
+}
+
+func (s *SegmentStore) closeSegments() error {
+	var err error
+	for _, seg := range s.segments {
+		if closeErr := seg.file.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (s *SegmentStore) runCompaction(interval time.Duration) {
+	defer close(s.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := s.Compact()
+			if err != nil {
+				Log(StoreComponent).Error("segment compaction failed", "error", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Compact rewrites the live records of every inactive segment whose dead
+// bytes exceed CompactionRatio into the active segment and removes it.
+func (s *SegmentStore) Compact() error {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, id := range s.segmentIDs() {
+		seg := s.segments[id]
+		if seg == s.active || seg.size == 0 || float64(seg.dead)/float64(seg.size) < s.CompactionRatio {
+			continue
+		}
+		err := s.compactSegment(seg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SegmentStore) compactSegment(seg *segment) error {
+	//Tombstones only need to be carried forward while an older segment may
+	//still hold a put they shadow
+	oldest := true
+	for id := range s.segments {
+		if id < seg.id {
+			oldest = false
+		}
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(seg.file, 0, seg.size))
+	var offset int64
+	moved := 0
+	for {
+		record, length, err := readSegmentRecord(reader, seg.size-offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		loc, live := s.index[record.key]
+		switch {
+		case record.kind == segmentPut && live && loc.segment == seg.id && loc.offset == offset:
+			newLoc, err := s.append(record, false)
+			if err != nil {
+				return err
+			}
+			s.index[record.key] = newLoc
+			moved++
+		case record.kind == segmentTombstone && !live && !oldest:
+			newLoc, err := s.append(record, false)
+			if err != nil {
+				return err
+			}
+			s.segments[newLoc.segment].dead += newLoc.length
+		}
+		offset += length
+	}
+
+	err := s.active.file.Sync()
+	if err != nil {
+		return err
+	}
+	delete(s.segments, seg.id)
+	seg.file.Close()
+	Log(StoreComponent).Info("compacted segment", "file", seg.file.Name(), "moved", moved, "reclaimed_bytes", seg.dead)
+	return os.Remove(seg.file.Name())
+}
+
+func (s *SegmentStore) append(record *segmentRecord, sync bool) (segmentLocation, error) {
+	b := encodeSegmentRecord(record)
+	if s.active.size > 0 && s.active.size+int64(len(b)) > s.MaxSegmentSize {
+		err := s.roll()
+		if err != nil {
+			return segmentLocation{}, err
+		}
+	}
+	_, err := s.active.file.WriteAt(b, s.active.size)
+	if err == nil && sync {
+		err = s.active.file.Sync()
+	}
+	if err != nil {
+		return segmentLocation{}, err
+	}
+	loc := segmentLocation{segment: s.active.id, offset: s.active.size, length: int64(len(b))}
+	s.active.size += int64(len(b))
+	return loc, nil
+}
+
+func (s *SegmentStore) roll() error {
+	var id uint64
+	if s.active != nil {
+		id = s.active.id + 1
+		err := s.active.file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	seg, err := s.openSegment(id)
+	if err != nil {
+		return err
+	}
+	s.active = seg
+	return nil
+}
+
+func (s *SegmentStore) openSegment(id uint64) (*segment, error) {
+	name := path.Join(s.Dir, fmt.Sprintf("%016x%s", id, segmentSuffix))
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	seg := &segment{id: id, file: file, size: info.Size()}
+	s.segments[id] = seg
+	return seg, nil
+}
+
+func (s *SegmentStore) segmentIDs() []uint64 {
+	ids := make([]uint64, 0, len(s.segments))
+	for id := range s.segments {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func encodeSegmentRecord(record *segmentRecord) []byte {
+	b := make([]byte, segmentHeaderSize+len(record.key)+len(record.value))
+	b[4] = record.kind
+	binary.BigEndian.PutUint32(b[5:9], uint32(len(record.key)))
+	binary.BigEndian.PutUint32(b[9:13], uint32(len(record.value)))
+	copy(b[segmentHeaderSize:], record.key)
+	copy(b[segmentHeaderSize+len(record.key):], record.value)
+	binary.BigEndian.PutUint32(b[0:4], crc32.Checksum(b[4:], castagnoli))
+	return b
+}
+
+// readSegmentRecord reads the next record, of at most remaining bytes, and
+// returns it with its encoded length. It returns io.EOF only at a clean
+// record boundary.
+func readSegmentRecord(reader *bufio.Reader, remaining int64) (*segmentRecord, int64, error) {
+	header := make([]byte, segmentHeaderSize)
+	n, err := io.ReadFull(reader, header)
+	if err == io.EOF {
+		return nil, 0, io.EOF
+	}
+	if err != nil {
+		return nil, int64(n), errCorruptRecord
+	}
+	kind := header[4]
+	keyLength := binary.BigEndian.Uint32(header[5:9])
+	valueLength := binary.BigEndian.Uint32(header[9:13])
+	if kind != segmentPut && kind != segmentTombstone {
+		return nil, 0, errCorruptRecord
+	}
+	//The lengths are not covered by a verified checksum yet, so they must not
+	//allocate more than the record can hold
+	if int64(keyLength)+int64(valueLength) > remaining-segmentHeaderSize {
+		return nil, 0, errCorruptRecord
+	}
+
+	data := make([]byte, int(keyLength)+int(valueLength))
+	_, err = io.ReadFull(reader, data)
+	if err != nil {
+		return nil, 0, errCorruptRecord
+	}
+	crc := crc32.Update(crc32.Checksum(header[4:], castagnoli), castagnoli, data)
+	if crc != binary.BigEndian.Uint32(header[0:4]) {
+		return nil, 0, errCorruptRecord
+	}
+	return &segmentRecord{
+		kind:  kind,
+		key:   string(data[:keyLength]),
+		value: data[keyLength:],
+	}, int64(segmentHeaderSize + len(data)), nil
+}
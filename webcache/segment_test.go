@@ -0,0 +1,157 @@
+package webcache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func newTestSegmentStore(t *testing.T, dir string, maxSegmentSize int64) *SegmentStore {
+	store, err := NewSegmentStore(dir, maxSegmentSize, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func Test_Segment_Put_Get_Delete(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segments")
+	defer os.RemoveAll(dir)
+	store := newTestSegmentStore(t, dir, DefaultSegmentSize)
+	defer store.Close()
+
+	store.Put("keyA", []byte("valueA"))
+	store.Put("keyB", []byte("valueB"))
+	store.Put("keyA", []byte("valueA2"))
+	store.Delete("keyB")
+
+	value, err := store.Get("keyA")
+	if err != nil || string(value) != "valueA2" {
+		t.Errorf("Expected valueA2, got %s (%v)", value, err)
+	}
+	if _, err := store.Get("keyB"); err != ErrNotFound {
+		t.Errorf("Expected deleted key to be missing, got %v", err)
+	}
+}
+
+func Test_Segment_Recovery(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segments")
+	defer os.RemoveAll(dir)
+	store := newTestSegmentStore(t, dir, DefaultSegmentSize)
+	store.Put("keyA", []byte("valueA"))
+	store.Put("keyB", []byte("valueB"))
+	store.Delete("keyA")
+	store.Close()
+
+	//Simulate a torn write at the tail of the segment
+	f, _ := os.OpenFile(path.Join(dir, "0000000000000000"+segmentSuffix), os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write([]byte{1, 2, 3, 4, segmentPut, 0})
+	f.Close()
+
+	store = newTestSegmentStore(t, dir, DefaultSegmentSize)
+	defer store.Close()
+	if _, err := store.Get("keyA"); err != ErrNotFound {
+		t.Errorf("Expected tombstoned key to stay deleted, got %v", err)
+	}
+	value, err := store.Get("keyB")
+	if err != nil || string(value) != "valueB" {
+		t.Errorf("Expected valueB, got %s (%v)", value, err)
+	}
+	store.Put("keyC", []byte("valueC"))
+	if value, _ := store.Get("keyC"); string(value) != "valueC" {
+		t.Errorf("Expected valueC after truncating the torn record, got %s", value)
+	}
+}
+
+func Test_Segment_Record_Length(t *testing.T) {
+	//A header claiming a 2GB value must be refused before it is allocated
+	header := make([]byte, segmentHeaderSize)
+	header[4] = segmentPut
+	binary.BigEndian.PutUint32(header[5:9], 4)
+	binary.BigEndian.PutUint32(header[9:13], 1<<31)
+	data := append(header, []byte("keyAvalue")...)
+	_, _, err := readSegmentRecord(bufio.NewReader(bytes.NewReader(data)), int64(len(data)))
+	if err != errCorruptRecord {
+		t.Errorf("Expected a record longer than the segment to be corrupt, got %v", err)
+	}
+
+	record := encodeSegmentRecord(&segmentRecord{kind: segmentPut, key: "keyA", value: []byte("valueA")})
+	_, _, err = readSegmentRecord(bufio.NewReader(bytes.NewReader(record)), int64(len(record)-1))
+	if err != errCorruptRecord {
+		t.Errorf("Expected a record longer than the bytes left to be corrupt, got %v", err)
+	}
+	decoded, length, err := readSegmentRecord(bufio.NewReader(bytes.NewReader(record)), int64(len(record)))
+	if err != nil || decoded.key != "keyA" || string(decoded.value) != "valueA" || length != int64(len(record)) {
+		t.Errorf("Expected keyA=valueA, got %v, %d (%v)", decoded, length, err)
+	}
+}
+
+func Test_Segment_Corrupt_Sealed(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segments")
+	defer os.RemoveAll(dir)
+	store := newTestSegmentStore(t, dir, 64)
+	for _, key := range []string{"keyA", "keyB", "keyC"} {
+		store.Put(key, []byte("value-"+key))
+	}
+	if len(store.segments) < 2 {
+		t.Fatalf("Expected several segments, got %d", len(store.segments))
+	}
+	store.Close()
+
+	//Flip a byte of the first record of the oldest, sealed, segment
+	sealed := path.Join(dir, "0000000000000000"+segmentSuffix)
+	b, _ := ioutil.ReadFile(sealed)
+	b[segmentHeaderSize] ^= 0xff
+	ioutil.WriteFile(sealed, b, 0644)
+
+	_, err := NewSegmentStore(dir, 64, time.Hour)
+	if err != ErrCorruptSegment {
+		t.Errorf("Expected a corrupt sealed segment to be reported, got %v", err)
+	}
+	info, _ := os.Stat(sealed)
+	if info.Size() != int64(len(b)) {
+		t.Errorf("Expected the sealed segment to be left as it is, was %d bytes and now %d", len(b), info.Size())
+	}
+}
+
+func Test_Segment_Compaction(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segments")
+	defer os.RemoveAll(dir)
+	store := newTestSegmentStore(t, dir, 64)
+	for _, key := range []string{"keyA", "keyB", "keyC", "keyD"} {
+		store.Put(key, []byte("value-"+key))
+	}
+	store.Delete("keyA")
+	store.Delete("keyC")
+
+	before := len(store.segments)
+	err := store.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.segments) >= before {
+		t.Errorf("Expected compaction to remove segments, had %d and now %d", before, len(store.segments))
+	}
+	store.Close()
+
+	store = newTestSegmentStore(t, dir, 64)
+	defer store.Close()
+	var keys []string
+	store.Iterate(func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if len(keys) != 2 {
+		t.Errorf("Expected 2 live keys after compaction, got %v", keys)
+	}
+	for _, key := range []string{"keyB", "keyD"} {
+		if value, err := store.Get(key); err != nil || string(value) != "value-"+key {
+			t.Errorf("Expected value-%s, got %s (%v)", key, value, err)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package webcache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+var ErrNotFound = errors.New("key not found")
+
+const tempFilePrefix = ".tmp-"
+
+var errCrashed = errors.New("simulated crash")
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// Store persists encoded disk cache entries by key.
+type Store interface {
+	Put(key string, value []byte) error
+	Get(key string) ([]byte, error) //Returns ErrNotFound if key is not stored
+	Delete(key string) error        //Deleting a missing key is not an error
+	Iterate(fn func(key string) error) error //fn may Delete the key it is given
+	Close() error
+}
+
+// Store types and the files kept under a cache root.
+const (
+	FlatStoreType    = "flat"
+	SegmentStoreType = "segment"
+	BoltStoreType    = "bolt"
+
+	JournalFilename = "journal.log"
+	MappingFilename = "mmap"
+)
+
+// OpenStore opens the store of the given type kept under cacheRoot.
+func OpenStore(storeType string, cacheRoot string) (Store, error) {
+	switch storeType {
+	case FlatStoreType:
+		store, err := NewFileStore(path.Join(cacheRoot, "diskcache"))
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case SegmentStoreType:
+		store, err := NewSegmentStore(path.Join(cacheRoot, "segments"), DefaultSegmentSize, DefaultCompactionInterval)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case BoltStoreType:
+		store, err := NewBoltStore(path.Join(cacheRoot, "cache.db"))
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Invalid disk cache store [%s]", storeType))
+}
+
+// TransactionalStore is implemented by stores whose writes are atomic and
+// durable on return, so a DiskCache using them needs no journal.
+type TransactionalStore interface {
+	Store
+	Transactional()
+}
+
+// Quarantiner is implemented by stores that can set a corrupt entry aside
+// for inspection instead of deleting it.
+type Quarantiner interface {
+	Quarantine(key string) error
+}
+
+// FileStore keeps every entry in its own file in a flat directory.
+type FileStore struct {
+	Root string
+	//crash, when set, is consulted at each step of Put. Returning true makes
+	//Put stop right there as if the process had died, which lets tests
+	//inject crashes.
+	crash func(step string) bool
+}
+
+func (s *FileStore) crashed(step string) bool {
+	return s.crash != nil && s.crash(step)
+}
+
+func NewFileStore(root string) (*FileStore, error) {
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		Log(StoreComponent).Info("creating diskcache root", "root", root)
+		err := os.MkdirAll(root, os.ModePerm)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &FileStore{Root: root}, nil
+}
+
+// Put writes value to a temporary file, syncs it and renames it into place,
+// so a crash never leaves a partially written entry under key.
+func (s *FileStore) Put(key string, value []byte) error {
+	f, err := ioutil.TempFile(s.Root, tempFilePrefix+key+"-")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if s.crashed("create") {
+		//The temporary file is left behind, but not its handle
+		f.Close()
+		return errCrashed
+	}
+
+	writer := bufio.NewWriter(f)
+	_, err = writer.Write(value)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		if s.crashed("sync") {
+			f.Close()
+			return errCrashed
+		}
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if s.crashed("rename") {
+		return errCrashed
+	}
+
+	err = os.Rename(tmp, path.Join(s.Root, key))
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if s.crashed("syncdir") {
+		return errCrashed
+	}
+	return syncDir(s.Root)
+}
+
+func (s *FileStore) Get(key string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path.Join(s.Root, key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return b, err
+}
+
+func (s *FileStore) Delete(key string) error {
+	// Only returns error if path does not exist. This operation should
+	// be idempotent so multiple calls to remove on the same file
+	// shouldn't matter
+	err := os.Remove(path.Join(s.Root, key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) Iterate(fn func(key string) error) error {
+	files, err := ioutil.ReadDir(s.Root)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), tempFilePrefix) {
+			continue
+		}
+		err = fn(f.Name())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeTempFiles deletes temporary files left behind by a Put that was
+// interrupted by a crash.
+func (s *FileStore) removeTempFiles() error {
+	files, err := ioutil.ReadDir(s.Root)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), tempFilePrefix) {
+			Log(StoreComponent).Warn("removing orphaned temporary file", "file", f.Name())
+			err = os.Remove(path.Join(s.Root, f.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Quarantine moves the entry to a quarantine directory next to Root.
+func (s *FileStore) Quarantine(key string) error {
+	dir := path.Join(path.Dir(s.Root), "quarantine")
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path.Join(s.Root, key), path.Join(dir, key))
+}
+
+func (s *FileStore) Close() error { return nil }
+
+// MemoryStore keeps entries in memory. It is mostly useful for tests.
+type MemoryStore struct {
+	sync.RWMutex
+	entries map[string][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string][]byte)}
+}
+
+func (s *MemoryStore) Put(key string, value []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	s.entries[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (s *MemoryStore) Get(key string) ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+	value, ok := s.entries[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), value...), nil
+}
+
+func (s *MemoryStore) Delete(key string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+func (s *MemoryStore) Iterate(fn func(key string) error) error {
+	s.RLock()
+	keys := make([]string, 0, len(s.entries))
+	for key := range s.entries {
+		keys = append(keys, key)
+	}
+	s.RUnlock()
+
+	for _, key := range keys {
+		err := fn(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Close() error { return nil }
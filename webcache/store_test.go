@@ -0,0 +1,75 @@
+package webcache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test_FileStore_Crash_Injection crashes FileStore.Put at every step,
+// optionally over an existing version of the entry, then restarts the
+// disk cache and checks that only complete entries are ever served.
+func Test_FileStore_Crash_Injection(t *testing.T) {
+	url := "http://a.com/page"
+	key := Hash(url)
+	oldBody, newBody := bytes.Repeat([]byte("old"), 1000), bytes.Repeat([]byte("new"), 2000)
+
+	for _, step := range []string{"create", "partial", "sync", "rename", "syncdir", ""} {
+		for _, overwrite := range []bool{false, true} {
+			dir, _ := ioutil.TempDir("", "crash")
+			store, _ := NewFileStore(path.Join(dir, "diskcache"))
+			dc := NewDiskCache(store, path.Join(dir, "journal.log"), 0)
+			if overwrite {
+				dc.Put(&DiskCacheEntry{Key: key, URL: url, Value: oldBody, ExpirationTime: time.Now().Add(time.Hour)})
+			}
+
+			store.crash = func(s string) bool { return s == step }
+			if step == "partial" {
+				//A crash part way through writing leaves a truncated temporary file
+				b, _ := encodeEntry(&Response{URL: url, Body: newBody})
+				ioutil.WriteFile(path.Join(store.Root, tempFilePrefix+key+"-1"), b[:len(b)/2], 0644)
+			} else {
+				dc.Put(&DiskCacheEntry{Key: key, URL: url, Value: newBody, ExpirationTime: time.Now().Add(time.Hour)})
+			}
+			store.crash = nil
+			//Release the journal before restarting on it
+			dc.Close()
+
+			//Whatever the store holds for the key must be a complete version
+			if b, err := store.Get(key); err == nil {
+				response, _, err := decodeEntry(b)
+				if err != nil || !(bytes.Equal(response.Body, oldBody) || bytes.Equal(response.Body, newBody)) {
+					t.Errorf("Step %q overwrite %t: store holds a partial entry", step, overwrite)
+				}
+			}
+
+			restarted := NewDiskCache(store, path.Join(dir, "journal.log"), 0)
+			readChannel := make(chan *DiskCacheEntry)
+			go restarted.Read(readChannel)
+			for entry := range readChannel {
+				if !bytes.Equal(entry.Value, oldBody) && !bytes.Equal(entry.Value, newBody) {
+					t.Errorf("Step %q overwrite %t: served a partial entry of %d bytes", step, overwrite, len(entry.Value))
+				}
+			}
+			restarted.Close()
+			if step == "" {
+				if b, err := store.Get(key); err != nil || !bytes.Contains(b, newBody) {
+					t.Errorf("Expected uninterrupted save to be stored")
+				}
+			}
+
+			files, _ := ioutil.ReadDir(store.Root)
+			for _, f := range files {
+				if strings.HasPrefix(f.Name(), tempFilePrefix) {
+					t.Errorf("Step %q overwrite %t: orphaned temporary file %s left after restart", step, overwrite, f.Name())
+				}
+			}
+			store.Close()
+			os.RemoveAll(dir)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package webcache
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// TTLRule sets how long responses belonging to a partition of the cache (a
+// host, a host suffix or a content type) stay fresh, instead of the
+// cache's expiration time.
+type TTLRule struct {
+	Kind    QuotaKind
+	Pattern string
+	TTL     time.Duration
+}
+
+// ParseTTLRule parses a TTL rule of the form kind:pattern=duration, e.g.
+// "type:image/*=24h" or "host:news.example.com=1m".
+func ParseTTLRule(rule string) (TTLRule, error) {
+	var r TTLRule
+	kind, pattern, ttl, err := parseRule("TTL", rule)
+	if err != nil {
+		return r, err
+	}
+	r.Kind = kind
+	r.Pattern = pattern
+
+	r.TTL, err = time.ParseDuration(ttl)
+	if err != nil || r.TTL <= 0 {
+		return r, errors.New(fmt.Sprintf("Invalid TTL [%s]", ttl))
+	}
+	return r, nil
+}
+
+func (r TTLRule) String() string {
+	return fmt.Sprintf("%s:%s=%s", quotaKindNames[r.Kind], r.Pattern, r.TTL)
+}
+
+// Matches reports whether a response for url with the given content type
+// falls in the rule's partition.
+func (r TTLRule) Matches(url string, contentType string) bool {
+	return matchesPartition(r.Kind, r.Pattern, url, contentType)
+}
@@ -0,0 +1,50 @@
+package webcache
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_TTL_Parse(t *testing.T) {
+	rule, err := ParseTTLRule("type:image/*=24h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.Kind != QuotaContentType || rule.Pattern != "image/*" || rule.TTL != 24*time.Hour {
+		t.Errorf("Expected type:image/*=24h, got %s", rule)
+	}
+
+	for _, s := range []string{"image/*=1h", "type:image/*", "type:image/*=soon", "host:a.com=-1s"} {
+		if _, err := ParseTTLRule(s); err == nil {
+			t.Errorf("Expected error parsing %s", s)
+		}
+	}
+}
+
+func Test_TTL_Rules(t *testing.T) {
+	images, _ := ParseTTLRule("type:image/*=24h")
+	news, _ := ParseTTLRule("host:news.a.com=1m")
+	wc := NewWebCache(NewLRUPolicy(), 1, 60, 0, nil)
+	wc.SetTTL(5*time.Minute, []TTLRule{news, images})
+
+	for _, test := range []struct {
+		url         string
+		contentType string
+		ttl         time.Duration
+	}{
+		{"http://a.com/logo.png", "image/png", 24 * time.Hour},
+		{"http://news.a.com/logo.png", "image/png", time.Minute},
+		{"http://a.com/", "text/html", 5 * time.Minute},
+	} {
+		if ttl := wc.TTL(test.url, test.contentType); ttl != test.ttl {
+			t.Errorf("Expected TTL %s for %s, got %s", test.ttl, test.url, ttl)
+		}
+	}
+
+	dc := NewDiskCache(NewMemoryStore(), t.TempDir()+"/journal.log", 0)
+	Admit(wc, dc, "http://a.com/logo.png", Value("png"), "image/png")
+	response, err := wc.Get(Hash("http://a.com/logo.png"))
+	if err != nil || time.Until(response.ExpirationTime) < 23*time.Hour {
+		t.Errorf("Expected the image to be cached for 24h, got %v (%v)", response, err)
+	}
+}
@@ -0,0 +1,346 @@
+package webcache
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WARC 1.1 (ISO 28500:2017) record types and block content types.
+const (
+	WARCVersion = "WARC/1.1"
+
+	WARCInfoType     = "warcinfo"
+	WARCResponseType = "response"
+
+	warcFieldsContentType   = "application/warc-fields"
+	warcResponseContentType = "application/http;msgtype=response"
+)
+
+var ErrInvalidWARC = errors.New("invalid WARC record")
+
+// WARCRecord is a single record of a WARC file.
+type WARCRecord struct {
+	Header textproto.MIMEHeader
+	Block  []byte
+}
+
+func (r *WARCRecord) Type() string {
+	return r.Header.Get("WARC-Type")
+}
+
+func (r *WARCRecord) TargetURI() string {
+	return r.Header.Get("WARC-Target-URI")
+}
+
+// Response parses the HTTP response held by a response record. Only
+// successful responses can be cached, so any other status is an error. The
+// content encoding is removed, as the proxy caches decoded bodies.
+func (r *WARCRecord) Response() (*Response, error) {
+	if r.Type() != WARCResponseType {
+		return nil, errors.New(fmt.Sprintf("Not a response record [%s]", r.Type()))
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(r.Block)), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("Response for %s has status %s", r.TargetURI(), resp.Status))
+	}
+
+	body, err := decodeContent(resp.Body, resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Response for %s: %s", r.TargetURI(), err))
+	}
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{
+		URL:         r.TargetURI(),
+		Body:        b,
+		ContentType: resp.Header.Get("Content-Type"),
+	}, nil
+}
+
+// decodeContent removes the content codings of body, listed in the order
+// they were applied by contentEncoding. Cached bodies are served without a
+// Content-Encoding, so codings that cannot be decoded, such as br, are an
+// error rather than cached as they are.
+func decodeContent(body io.Reader, contentEncoding string) (io.Reader, error) {
+	codings := strings.Split(contentEncoding, ",")
+	for i := len(codings) - 1; i >= 0; i-- {
+		switch coding := strings.ToLower(strings.TrimSpace(codings[i])); coding {
+		case "", "identity":
+		case "gzip", "x-gzip":
+			gz, err := gzip.NewReader(body)
+			if err != nil {
+				return nil, err
+			}
+			body = gz
+		case "deflate":
+			//deflate is meant to be zlib wrapped, but some servers send raw
+			//deflate data
+			reader := bufio.NewReader(body)
+			header, _ := reader.Peek(2)
+			if len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+				z, err := zlib.NewReader(reader)
+				if err != nil {
+					return nil, err
+				}
+				body = z
+			} else {
+				body = flate.NewReader(reader)
+			}
+		default:
+			return nil, errors.New(fmt.Sprintf("Unsupported Content-Encoding %s", coding))
+		}
+	}
+	return body, nil
+}
+
+// WARCWriter writes WARC records. When compressed, every record is written
+// as its own gzip member, as is customary for .warc.gz files, so that
+// readers can seek to individual records.
+type WARCWriter struct {
+	w        io.Writer
+	compress bool
+}
+
+func NewWARCWriter(w io.Writer, compress bool) *WARCWriter {
+	return &WARCWriter{w: w, compress: compress}
+}
+
+// WriteInfo writes a warcinfo record describing the file.
+func (w *WARCWriter) WriteInfo(filename string) error {
+	var fields bytes.Buffer
+	fmt.Fprintf(&fields, "software: webcache\r\n")
+	fmt.Fprintf(&fields, "format: WARC File Format 1.1\r\n")
+	fmt.Fprintf(&fields, "conformsTo: http://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/\r\n")
+
+	header := [][2]string{
+		{"WARC-Type", WARCInfoType},
+		{"WARC-Record-ID", newWARCRecordID()},
+		{"WARC-Date", time.Now().UTC().Format(time.RFC3339)},
+	}
+	if filename != "" {
+		header = append(header, [2]string{"WARC-Filename", filename})
+	}
+	header = append(header, [2]string{"Content-Type", warcFieldsContentType})
+	return w.writeRecord(header, fields.Bytes())
+}
+
+// WriteResponse writes response as a response record captured at date.
+func (w *WARCWriter) WriteResponse(response *Response, date time.Time) error {
+	var block bytes.Buffer
+	fmt.Fprintf(&block, "HTTP/1.1 200 OK\r\n")
+	if response.ContentType != "" {
+		fmt.Fprintf(&block, "Content-Type: %s\r\n", response.ContentType)
+	}
+	fmt.Fprintf(&block, "Content-Length: %d\r\n\r\n", len(response.Body))
+	block.Write(response.Body)
+
+	return w.writeRecord([][2]string{
+		{"WARC-Type", WARCResponseType},
+		{"WARC-Record-ID", newWARCRecordID()},
+		{"WARC-Date", date.UTC().Format(time.RFC3339)},
+		{"WARC-Target-URI", response.URL},
+		{"WARC-Payload-Digest", warcDigest(response.Body)},
+		{"WARC-Block-Digest", warcDigest(block.Bytes())},
+		{"Content-Type", warcResponseContentType},
+	}, block.Bytes())
+}
+
+func (w *WARCWriter) writeRecord(header [][2]string, block []byte) error {
+	out := w.w
+	var gz *gzip.Writer
+	if w.compress {
+		gz = gzip.NewWriter(w.w)
+		out = gz
+	}
+
+	writer := bufio.NewWriter(out)
+	fmt.Fprintf(writer, "%s\r\n", WARCVersion)
+	for _, field := range header {
+		fmt.Fprintf(writer, "%s: %s\r\n", field[0], field[1])
+	}
+	fmt.Fprintf(writer, "Content-Length: %d\r\n\r\n", len(block))
+	writer.Write(block)
+	writer.WriteString("\r\n\r\n")
+	err := writer.Flush()
+	if err != nil {
+		return err
+	}
+	if gz != nil {
+		return gz.Close()
+	}
+	return nil
+}
+
+func newWARCRecordID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40 //Version 4
+	b[8] = b[8]&0x3f | 0x80 //RFC 4122 variant
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func warcDigest(b []byte) string {
+	sum := sha1.Sum(b)
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum[:])
+}
+
+// WARCReader reads the records of a WARC file, which may be gzip compressed.
+type WARCReader struct {
+	r *bufio.Reader
+}
+
+func NewWARCReader(r io.Reader) (*WARCReader, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(2)
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		//Concatenated gzip members are read as one stream
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		br = bufio.NewReader(gz)
+	}
+	return &WARCReader{r: br}, nil
+}
+
+// Next returns the next record, or io.EOF once there are no more records.
+func (r *WARCReader) Next() (*WARCRecord, error) {
+	//Skip the blank lines ending the previous record
+	line, err := r.r.ReadString('\n')
+	for err == nil && strings.TrimSpace(line) == "" {
+		line, err = r.r.ReadString('\n')
+	}
+	if err == io.EOF && strings.TrimSpace(line) == "" {
+		return nil, io.EOF
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "WARC/") {
+		return nil, ErrInvalidWARC
+	}
+
+	header, err := textproto.NewReader(r.r).ReadMIMEHeader()
+	if err != nil {
+		return nil, ErrInvalidWARC
+	}
+	length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return nil, ErrInvalidWARC
+	}
+	block, err := ioutil.ReadAll(io.LimitReader(r.r, length))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(block)) != length {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return &WARCRecord{Header: header, Block: block}, nil
+}
+
+// ExportWARC writes the entries of dc accepted by match, or all of them if
+// match is nil, to w as response records dated when they were stored.
+// Entries that are corrupt or not acknowledged by the journal are skipped.
+// It returns the number of entries written.
+func (dc *DiskCache) ExportWARC(w *WARCWriter, filename string, match func(*Response) bool) (int, error) {
+	var validEntries map[string]bool
+	if dc.journal != nil {
+		validEntries = dc.journal.entries()
+	}
+	err := w.WriteInfo(filename)
+	if err != nil {
+		return 0, err
+	}
+
+	exported := 0
+	err = dc.store.Iterate(func(key string) error {
+		if dc.journal != nil && !validEntries[key] {
+			return nil
+		}
+		b, err := dc.store.Get(key)
+		if err != nil {
+			return nil
+		}
+		response, _, err := decodeEntry(b)
+		if err != nil || response.URL == "" {
+			Log(ImportComponent).Warn("skipping unreadable entry", "key", key)
+			return nil
+		}
+		if match != nil && !match(response) {
+			return nil
+		}
+		//Entries stored before their time was recorded are dated now
+		date := response.StoredTime
+		if date.IsZero() {
+			date = time.Now()
+		}
+		err = w.WriteResponse(response, date)
+		if err != nil {
+			return err
+		}
+		exported++
+		return nil
+	})
+	return exported, err
+}
+
+// ImportWARC caches the successful responses recorded in a WARC file through
+// Admit, so capacity, quotas and the replacement policy apply as for
+// proxied responses, and registers their mappings with index if it is not
+// nil. It returns the number of responses cached.
+func ImportWARC(r io.Reader, wc Cache, dc *DiskCache, index *InvertedIndex) (int, error) {
+	reader, err := NewWARCReader(r)
+	if err != nil {
+		return 0, err
+	}
+	imported := 0
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return imported, nil
+		}
+		if err != nil {
+			return imported, err
+		}
+		if record.Type() != WARCResponseType {
+			continue
+		}
+		response, err := record.Response()
+		if err != nil {
+			Log(ImportComponent).Warn("skipping WARC record", "error", err)
+			continue
+		}
+
+		cached, err := Admit(wc, dc, response.URL, response.Body, response.ContentType)
+		if err != nil {
+			return imported, err
+		}
+		if cached {
+			if index != nil {
+				index.NewMapping <- Mapping{Original: response.URL, Hashed: Hash(response.URL)}
+			}
+			imported++
+		}
+	}
+}
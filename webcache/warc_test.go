@@ -0,0 +1,171 @@
+package webcache
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_WARC_Export_Import(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "warc")
+	defer os.RemoveAll(dir)
+
+	stored := time.Now().Add(-time.Hour)
+	for _, compress := range []bool{false, true} {
+		source := NewDiskCache(NewMemoryStore(), path.Join(dir, "source.log"), 0)
+		source.Put(&DiskCacheEntry{Key: Hash("http://a.com/"), URL: "http://a.com/", Value: Value("<html></html>"), ContentType: "text/html", StoredTime: stored})
+		source.Put(&DiskCacheEntry{Key: Hash("http://a.com/v.mp4"), URL: "http://a.com/v.mp4", Value: Value("video"), ContentType: "video/mp4"})
+
+		var buf bytes.Buffer
+		exported, err := source.ExportWARC(NewWARCWriter(&buf, compress), "test.warc", func(r *Response) bool {
+			return strings.HasPrefix(r.ContentType, "text/")
+		})
+		if err != nil || exported != 1 {
+			t.Fatalf("Expected 1 exported entry, got %d (%v)", exported, err)
+		}
+
+		reader, err := NewWARCReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var types []string
+		for {
+			record, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			types = append(types, record.Type())
+			if record.Type() == WARCResponseType && record.Header.Get("WARC-Date") != stored.UTC().Format(time.RFC3339) {
+				t.Errorf("Expected the response to be dated when it was stored, %s, got %s", stored.UTC().Format(time.RFC3339), record.Header.Get("WARC-Date"))
+			}
+		}
+		if strings.Join(types, ",") != "warcinfo,response" {
+			t.Errorf("Expected warcinfo and response records, got %v", types)
+		}
+
+		store := NewMemoryStore()
+		dc := NewDiskCache(store, path.Join(dir, "dest.log"), 0)
+		wc := NewWebCache(NewLRUPolicy(), 1, 60, 0, nil)
+		imported, err := ImportWARC(bytes.NewReader(buf.Bytes()), wc, dc, nil)
+		if err != nil || imported != 1 {
+			t.Fatalf("Expected 1 imported entry, got %d (%v)", imported, err)
+		}
+		response, err := wc.Get(Hash("http://a.com/"))
+		if err != nil || string(response.Body) != "<html></html>" || response.ContentType != "text/html" {
+			t.Errorf("Expected imported entry in the web cache, got %v", err)
+		}
+		b, err := store.Get(Hash("http://a.com/"))
+		if err != nil {
+			t.Fatalf("Expected imported entry on disk: %s", err)
+		}
+		if response, _ := DecodeEntry(b); response.URL != "http://a.com/" || !response.ExpirationTime.After(time.Now()) {
+			t.Errorf("Expected imported entry to expire in the future, got %+v", response)
+		}
+	}
+}
+
+func Test_WARC_Import_Respects_Capacity(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "warc")
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	w := NewWARCWriter(&buf, false)
+	for _, url := range []string{"http://a.com/1", "http://a.com/2", "http://a.com/3"} {
+		w.WriteResponse(&Response{URL: url, Body: make(Value, 400000)}, time.Now())
+	}
+	//Only successful responses are imported
+	buf.WriteString("WARC/1.1\r\nWARC-Type: response\r\nWARC-Target-URI: http://a.com/404\r\nContent-Length: 26\r\n\r\nHTTP/1.1 404 Not Found\r\n\r\n\r\n\r\n")
+
+	store := NewMemoryStore()
+	dc := NewDiskCache(store, path.Join(dir, "journal.log"), 0)
+	wc := NewWebCache(NewLRUPolicy(), 1, 60, 0, nil)
+	imported, err := ImportWARC(&buf, wc, dc, nil)
+	if err != nil || imported != 3 {
+		t.Fatalf("Expected 3 imported entries, got %d (%v)", imported, err)
+	}
+	if wc.Contains(Hash("http://a.com/1")) || !wc.Contains(Hash("http://a.com/2")) || !wc.Contains(Hash("http://a.com/3")) {
+		t.Errorf("Expected the least recently used entry to be evicted")
+	}
+	if _, err := store.Get(Hash("http://a.com/1")); err != ErrNotFound {
+		t.Errorf("Expected the evicted entry to be removed from disk")
+	}
+	if wc.Contains(Hash("http://a.com/404")) {
+		t.Errorf("Expected the unsuccessful response to be skipped")
+	}
+}
+
+func Test_WARC_Content_Encoding(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "warc")
+	defer os.RemoveAll(dir)
+
+	body := strings.Repeat("<p>encoded</p>", 100)
+	var gzipped, zlibbed, deflated bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte(body))
+	gz.Close()
+	z := zlib.NewWriter(&zlibbed)
+	z.Write([]byte(body))
+	z.Close()
+	fl, _ := flate.NewWriter(&deflated, flate.DefaultCompression)
+	fl.Write([]byte(body))
+	fl.Close()
+
+	var buf bytes.Buffer
+	for _, r := range []struct {
+		url      string
+		encoding string
+		body     []byte
+	}{
+		{"http://a.com/gzip", "gzip", gzipped.Bytes()},
+		{"http://a.com/zlib", "deflate", zlibbed.Bytes()},
+		{"http://a.com/deflate", "deflate", deflated.Bytes()},
+		{"http://a.com/identity", "identity", []byte(body)},
+		{"http://a.com/br", "br", []byte("brotli")},
+	} {
+		block := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: text/html\r\nContent-Encoding: %s\r\nContent-Length: %d\r\n\r\n%s", r.encoding, len(r.body), r.body)
+		fmt.Fprintf(&buf, "WARC/1.1\r\nWARC-Type: response\r\nWARC-Target-URI: %s\r\nContent-Length: %d\r\n\r\n%s\r\n\r\n", r.url, len(block), block)
+	}
+
+	dc := NewDiskCache(NewMemoryStore(), path.Join(dir, "journal.log"), 0)
+	defer dc.Close()
+	wc := NewWebCache(NewLRUPolicy(), 1, 60, 0, nil)
+	imported, err := ImportWARC(&buf, wc, dc, nil)
+	if err != nil || imported != 4 {
+		t.Fatalf("Expected 4 imported entries, got %d (%v)", imported, err)
+	}
+	for _, url := range []string{"http://a.com/gzip", "http://a.com/zlib", "http://a.com/deflate", "http://a.com/identity"} {
+		response, err := wc.Get(Hash(url))
+		if err != nil || string(response.Body) != body {
+			t.Errorf("Expected %s to be decoded, got %v", url, err)
+		}
+	}
+	//The proxy could only serve the br body as garbage
+	if wc.Contains(Hash("http://a.com/br")) {
+		t.Errorf("Expected the response with an unsupported encoding to be skipped")
+	}
+}
+
+func Test_WARC_Reader_Invalid(t *testing.T) {
+	for _, data := range []string{
+		"not a warc file\r\n",
+		"WARC/1.1\r\nWARC-Type: response\r\n\r\n",
+		"WARC/1.1\r\nContent-Length: 10\r\n\r\nshort",
+	} {
+		reader, _ := NewWARCReader(strings.NewReader(data))
+		if _, err := reader.Next(); err == nil || err == io.EOF {
+			t.Errorf("Expected an error reading %q, got %v", data, err)
+		}
+	}
+}
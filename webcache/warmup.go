@@ -0,0 +1,246 @@
+package webcache
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultWarmupConcurrency = 8
+	DefaultWarmupFillRatio   = 0.9
+
+	//Sitemap indexes may only list sitemaps, but guard against cycles
+	maxSitemapDepth = 4
+	//How often warm-up progress is logged, in URLs
+	warmupProgressInterval = 100
+)
+
+// Warmer fills a cache by requesting lists of URLs through a handler, so
+// that responses take the same fetch, rewrite and save path as the
+// requests of clients.
+type Warmer struct {
+	Handler     http.Handler
+	Client      *http.Client //Fetches remote sitemaps and URL lists
+	Stats       func() CacheStats
+	Concurrency int
+	FillRatio   float64 //Warm-up stops once the cache is this full
+}
+
+// WarmupReport summarizes a warm-up.
+type WarmupReport struct {
+	Requested int
+	Failed    map[string]string //Error by URL
+	Skipped   int               //URLs not requested because the cache filled up
+}
+
+// Load reads the URLs listed by source, a local file or an http(s) URL
+// holding either one URL per line or a sitemap. Sitemap indexes are
+// followed, and gzipped sitemaps are supported.
+func (w *Warmer) Load(source string) ([]string, error) {
+	return w.load(source, 0, make(map[string]bool))
+}
+
+func (w *Warmer) load(source string, depth int, seen map[string]bool) ([]string, error) {
+	if seen[source] {
+		return nil, nil
+	}
+	seen[source] = true
+	if depth > maxSitemapDepth {
+		return nil, errors.New(fmt.Sprintf("Sitemap %s is nested too deeply", source))
+	}
+
+	b, err := w.read(source)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(b), []byte("<")) {
+		return parseURLList(b), nil
+	}
+
+	var sitemap struct {
+		XMLName  xml.Name
+		URLs     []string `xml:"url>loc"`
+		Sitemaps []string `xml:"sitemap>loc"`
+	}
+	err = xml.Unmarshal(b, &sitemap)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid sitemap %s: %s", source, err))
+	}
+	switch sitemap.XMLName.Local {
+	case "urlset":
+		var urls []string
+		for _, url := range sitemap.URLs {
+			urls = append(urls, strings.TrimSpace(url))
+		}
+		return urls, nil
+	case "sitemapindex":
+		var urls []string
+		for _, loc := range sitemap.Sitemaps {
+			listed, err := w.load(strings.TrimSpace(loc), depth+1, seen)
+			if err != nil {
+				return nil, err
+			}
+			urls = append(urls, listed...)
+		}
+		return urls, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Invalid sitemap %s: unexpected <%s> element", source, sitemap.XMLName.Local))
+}
+
+func (w *Warmer) read(source string) ([]byte, error) {
+	var r io.Reader
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		client := w.Client
+		if client == nil {
+			client = http.DefaultClient
+		}
+		resp, err := client.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.New(fmt.Sprintf("Unable to fetch %s: %s", source, resp.Status))
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(2)
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(gz)
+	}
+	return ioutil.ReadAll(br)
+}
+
+// parseURLList returns the URLs listed one per line, ignoring blank lines
+// and # comments.
+func parseURLList(b []byte) []string {
+	var urls []string
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			urls = append(urls, line)
+		}
+	}
+	return urls
+}
+
+// Run requests urls with at most Concurrency requests in flight, and stops
+// requesting once the cache is FillRatio full.
+func (w *Warmer) Run(urls []string) *WarmupReport {
+	report := &WarmupReport{Failed: make(map[string]string)}
+	var lock sync.Mutex
+	concurrency := w.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultWarmupConcurrency
+	}
+
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for url := range queue {
+				if w.full() {
+					lock.Lock()
+					if report.Skipped == 0 {
+						Log(WarmupComponent).Info("cache is full, skipping the remaining URLs", "fill", w.Stats().Fill())
+					}
+					report.Skipped++
+					lock.Unlock()
+					continue
+				}
+				err := w.request(url)
+
+				lock.Lock()
+				report.Requested++
+				if err != nil {
+					Log(WarmupComponent).Warn("request failed", "url", url, "error", err)
+					report.Failed[url] = err.Error()
+				}
+				if report.Requested%warmupProgressInterval == 0 {
+					w.progress(report, len(urls))
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+
+	for _, url := range urls {
+		queue <- url
+	}
+	close(queue)
+	wg.Wait()
+
+	w.progress(report, len(urls))
+	return report
+}
+
+func (w *Warmer) full() bool {
+	return w.Stats != nil && w.FillRatio > 0 && w.Stats().Fill() >= w.FillRatio
+}
+
+func (w *Warmer) progress(report *WarmupReport, total int) {
+	fill := 0.0
+	if w.Stats != nil {
+		fill = w.Stats().Fill()
+	}
+	Log(WarmupComponent).Info("progress", "requested", report.Requested, "total", total, "failed", len(report.Failed), "fill", fill)
+}
+
+func (w *Warmer) request(url string) error {
+	r, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	rw := &discardResponseWriter{header: make(http.Header)}
+	w.Handler.ServeHTTP(rw, r)
+	if rw.status != 0 && (rw.status < 200 || rw.status >= 300) {
+		return errors.New(fmt.Sprintf("%d %s", rw.status, http.StatusText(rw.status)))
+	}
+	return nil
+}
+
+// discardResponseWriter discards a response, remembering only its status.
+type discardResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardResponseWriter) Header() http.Header { return w.header }
+
+func (w *discardResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *discardResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return len(b), nil
+}
@@ -0,0 +1,112 @@
+package webcache
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func Test_Warmer_Load_Sitemaps(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sitemap.xml":
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>%[1]s/pages.xml</loc></sitemap>
+  <sitemap><loc>%[1]s/images.xml.gz</loc></sitemap>
+  <sitemap><loc>%[1]s/sitemap.xml</loc></sitemap>
+</sitemapindex>`, server.URL)
+		case "/pages.xml":
+			fmt.Fprint(w, `<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>http://a.com/</loc><lastmod>2020-01-01</lastmod></url>
+  <url><loc> http://a.com/about </loc></url>
+</urlset>`)
+		case "/images.xml.gz":
+			gz := gzip.NewWriter(w)
+			fmt.Fprint(gz, `<urlset><url><loc>http://a.com/logo.png</loc></url></urlset>`)
+			gz.Close()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	warmer := &Warmer{}
+	urls, err := warmer.Load(server.URL + "/sitemap.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(urls, " ") != "http://a.com/ http://a.com/about http://a.com/logo.png" {
+		t.Errorf("Expected the URLs of both sitemaps, got %v", urls)
+	}
+
+	if _, err := warmer.Load(server.URL + "/missing.xml"); err == nil {
+		t.Errorf("Expected an error loading a missing sitemap")
+	}
+}
+
+func Test_Warmer_Load_URL_List(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "warmup")
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "urls.txt")
+	ioutil.WriteFile(filename, []byte("# Front page\nhttp://a.com/\n\n  http://a.com/about\n"), 0644)
+
+	urls, err := (&Warmer{}).Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(urls, " ") != "http://a.com/ http://a.com/about" {
+		t.Errorf("Expected 2 URLs, got %v", urls)
+	}
+}
+
+func Test_Warmer_Run(t *testing.T) {
+	var lock sync.Mutex
+	var requested []string
+	stats := CacheStats{MaxCapacity: 10}
+	warmer := &Warmer{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			requested = append(requested, r.URL.String())
+			if r.URL.Path == "/fail" {
+				http.Error(w, "upstream unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			if r.URL.Path == "/missing" {
+				http.NotFound(w, r)
+				return
+			}
+			stats.CurrentCapacity++
+			w.Write([]byte("ok"))
+		}),
+		Stats: func() CacheStats {
+			lock.Lock()
+			defer lock.Unlock()
+			return stats
+		},
+		Concurrency: 1,
+		FillRatio:   0.3,
+	}
+
+	report := warmer.Run([]string{"http://a.com/1", "http://a.com/fail", "http://a.com/missing", "http://a.com/2", "http://a.com/3", "http://a.com/4", "http://a.com/5"})
+	if report.Requested != 5 || len(requested) != 5 {
+		t.Errorf("Expected warm-up to stop once the cache was 30%% full, got %d requests", report.Requested)
+	}
+	if report.Skipped != 2 {
+		t.Errorf("Expected 2 skipped URLs, got %d", report.Skipped)
+	}
+	_, failed := report.Failed["http://a.com/fail"]
+	_, missing := report.Failed["http://a.com/missing"]
+	if !failed || !missing || len(report.Failed) != 2 {
+		t.Errorf("Expected the failed URLs to be reported, got %v", report.Failed)
+	}
+}
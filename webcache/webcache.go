@@ -2,11 +2,10 @@ package webcache
 
 import (
 	"crypto/sha256"
-	"errors"
 	"fmt"
-	"log"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,42 +13,151 @@ type Value []byte
 
 type Cache interface {
 	Get(url string)  (*Response, error)
+	Contains(key string) bool
 	Delete(key string)
 	Set(url string, response *Response)
-	FindEvictionEntries(url string, value Value)([]string, bool)
+	FindEvictionEntries(url string, value Value, contentType string)([]string, bool)
+	Release(url string, value Value, contentType string)
 	Initialize(key string, value *Response)
 	ExpirationTime() time.Duration
+	TTL(url string, contentType string) time.Duration
+	SetTTL(expirationTime time.Duration, rules []TTLRule)
+	SetQuotas(quotas []Quota)
+	Stats() CacheStats
+	Entries() []EntryInfo
+	Rank(key string) (int, bool)
 	PrintCapacity()
 }
 
+// CacheStats is a snapshot of the usage of a cache. Sizes are in bytes and
+// include the overhead of every entry.
+type CacheStats struct {
+	CurrentCapacity int `json:"currentCapacity"`
+	MaxCapacity     int `json:"maxCapacity"`
+	PendingSet      int `json:"pendingSet"`
+	Entries         int `json:"entries"`
+	MaxEntries      int `json:"maxEntries"`
+}
+
+// EntryInfo describes a cached entry.
+type EntryInfo struct {
+	Key            string    `json:"key"`
+	URL            string    `json:"url"`
+	ContentType    string    `json:"contentType"`
+	Size           int       `json:"size"`
+	ExpirationTime time.Time `json:"expirationTime"`
+	Expired        bool      `json:"expired"`
+	Hits           uint64    `json:"hits"`
+}
+
+// Fill returns the fraction of the cache's capacity that is in use or
+// about to be.
+func (s CacheStats) Fill() float64 {
+	fill := float64(s.CurrentCapacity+s.PendingSet) / float64(s.MaxCapacity)
+	if s.MaxEntries > 0 && float64(s.Entries)/float64(s.MaxEntries) > fill {
+		fill = float64(s.Entries) / float64(s.MaxEntries)
+	}
+	return fill
+}
+
 type WebCache struct {
 	pendingSet int
+	pendingEntries int
 	currentCapacity int
 	maxCapacity int
+	maxEntries int
 	expirationTime time.Duration
+	ttlRules    []TTLRule
 	policy      Policy
+	quotas      []*quotaUsage
 	sync.RWMutex
 	cache      map[string]*Entry
 	updateChan chan *Entry
 }
 
 
-func NewWebCache(policy Policy, cacheSize int, expirationTime int) Cache {
+// NewWebCache creates a cache holding at most cacheSize MB. A positive
+// maxEntries additionally limits the number of entries, regardless of size.
+func NewWebCache(policy Policy, cacheSize int, expirationTime int, maxEntries int, quotas []Quota) Cache {
 
 	c := &WebCache{
 		currentCapacity: 0,
 		pendingSet: 0,
 		maxCapacity: cacheSize*1000000,
+		maxEntries: maxEntries,
 		expirationTime: time.Duration(expirationTime)*time.Second,
 		cache:          make(map[string]*Entry),
 		updateChan:     make(chan *Entry),
 		policy:         policy,
 	}
+	for _, quota := range quotas {
+		c.quotas = append(c.quotas, &quotaUsage{Quota: quota})
+	}
 
 	return c
 }
 
-func (c *WebCache) ExpirationTime() time.Duration { return c.expirationTime }
+func (c *WebCache) ExpirationTime() time.Duration {
+	c.RLock()
+	defer c.RUnlock()
+	return c.expirationTime
+}
+
+// TTL returns how long a response for url with the given content type stays
+// fresh: the TTL of the first matching rule, or the expiration time.
+func (c *WebCache) TTL(url string, contentType string) time.Duration {
+	c.RLock()
+	defer c.RUnlock()
+	for _, rule := range c.ttlRules {
+		if rule.Matches(url, contentType) {
+			return rule.TTL
+		}
+	}
+	return c.expirationTime
+}
+
+// SetTTL changes the expiration time and TTL rules of responses cached from
+// now on. Cached entries keep their expiration time.
+func (c *WebCache) SetTTL(expirationTime time.Duration, rules []TTLRule) {
+	c.Lock()
+	defer c.Unlock()
+	c.expirationTime = expirationTime
+	c.ttlRules = rules
+}
+
+// SetQuotas replaces the quotas of the cache. The usage of the new quotas is
+// recomputed from the cached entries; partitions found over quota shrink as
+// new entries are admitted to them.
+func (c *WebCache) SetQuotas(quotas []Quota) {
+	c.Lock()
+	defer c.Unlock()
+	pending := make(map[string]int)
+	for _, q := range c.quotas {
+		pending[q.String()] = q.pending
+	}
+	c.quotas = nil
+	for _, quota := range quotas {
+		q := &quotaUsage{Quota: quota, pending: pending[quota.String()]}
+		for _, entry := range c.cache {
+			if q.matchesEntry(entry) {
+				q.current += entry.Size
+			}
+		}
+		c.quotas = append(c.quotas, q)
+	}
+}
+
+func (c *WebCache) Stats() CacheStats {
+	c.RLock()
+	defer c.RUnlock()
+	return CacheStats{
+		CurrentCapacity: c.currentCapacity,
+		MaxCapacity:     c.maxCapacity,
+		PendingSet:      c.pendingSet,
+		Entries:         len(c.cache),
+		MaxEntries:      c.maxEntries,
+	}
+}
 
 func (c *WebCache) Get(url string) (*Response, error) {
 	c.RLock()
@@ -57,40 +165,143 @@ func (c *WebCache) Get(url string) (*Response, error) {
 
 	entry, ok := c.cache[RemoveHTTPPrefix(url)]
 	if !ok {
-		return nil, errors.New(fmt.Sprintf("MISS - %s", url))
+		return nil, &MissError{URL: url}
 	}
 	if !entry.Expired() {
+		atomic.AddUint64(&entry.Served, 1)
 		c.promote(entry)
 		//log.Println(fmt.Sprintf("HIT - %s", url))
 		return entry.Response, nil //TODO this response is not being read properly
 	} else {
-		return nil, errors.New(fmt.Sprintf("EXPIRED - %s", url))
+		return nil, &MissError{URL: url, Expired: true}
+	}
+}
+
+// MissError is returned by Get for URLs that are not cached or whose entry
+// has expired.
+type MissError struct {
+	URL     string
+	Expired bool
+}
+
+func (e *MissError) Error() string {
+	if e.Expired {
+		return fmt.Sprintf("EXPIRED - %s", e.URL)
 	}
+	return fmt.Sprintf("MISS - %s", e.URL)
+}
+
+// Entries returns a snapshot of the cached entries.
+func (c *WebCache) Entries() []EntryInfo {
+	c.RLock()
+	defer c.RUnlock()
+	entries := make([]EntryInfo, 0, len(c.cache))
+	for key, entry := range c.cache {
+		entries = append(entries, EntryInfo{
+			Key:            key,
+			URL:            entry.URL,
+			ContentType:    entry.ContentType,
+			Size:           entry.Size,
+			ExpirationTime: entry.ExpirationTime,
+			Expired:        entry.Expired(),
+			Hits:           atomic.LoadUint64(&entry.Served),
+		})
+	}
+	return entries
+}
+
+// Rank returns the number of entries the policy would evict before the
+// entry of key, and whether key is cached.
+func (c *WebCache) Rank(key string) (int, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	entry, ok := c.cache[key]
+	if !ok {
+		return 0, false
+	}
+	return c.policy.Rank(entry), true
+}
+
+// Contains reports whether key is cached, without promoting it.
+func (c *WebCache) Contains(key string) bool {
+	c.RLock()
+	defer c.RUnlock()
+	_, ok := c.cache[key]
+	return ok
 }
 
-func (c *WebCache) FindEvictionEntries(url string, value Value) (toDelete []string, cache bool) {
+func (c *WebCache) FindEvictionEntries(url string, value Value, contentType string) (toDelete []string, cache bool) {
 	c.Lock()
 	defer c.Unlock()
 
-	length := len(value)
+	length := EntrySize(value)
+	quotas := c.matchingQuotas(url, contentType)
 
 	if length > c.maxCapacity {
-		log.Println(fmt.Sprintf("Not Caching - Response for %s too large.", url))
+		Log(CacheComponent).Info("not caching, response too large", "url", url, "bytes", length)
 		return toDelete, false
-	} else if (c.maxCapacity - (c.currentCapacity + c.pendingSet)) < length {
+	}
+	for _, q := range quotas {
+		if length > q.Limit(c.maxCapacity) {
+			Log(CacheComponent).Info("not caching, response exceeds quota", "url", url, "quota", q.String())
+			return toDelete, false
+		}
+	}
+
+	//Evict within each exceeded quota partition first
+	var evicted []*Entry
+	for _, q := range quotas {
+		room := q.Limit(c.maxCapacity) - (q.current + q.pending)
+		for _, e := range evicted {
+			if q.matchesEntry(e) {
+				room += e.Size
+			}
+		}
+		for room < length {
+			toEvict := c.policy.EvictWhere(q.matchesEntry)
+			if toEvict == nil {
+				Log(CacheComponent).Info("not caching, unable to make room within quota", "url", url, "quota", q.String())
+				return toDelete, false
+			}
+			evicted = append(evicted, toEvict)
+			toDelete = append(toDelete, toEvict.Key)
+			room += toEvict.Size
+		}
+	}
+
+	room := c.maxCapacity - (c.currentCapacity + c.pendingSet)
+	for _, e := range evicted {
+		room += e.Size
+	}
+	if room < length {
 		//log.Println(fmt.Sprintf("Need to make room for %s in the cache. Start evicting.", url))
-		room := c.maxCapacity - (c.currentCapacity + c.pendingSet)
 		for room < length {
 			toEvict := c.policy.Evict()
 			if toEvict == nil {
-				log.Println(fmt.Sprintf("Not Caching - Unable to make room for %s.", url))
+				Log(CacheComponent).Info("not caching, unable to make room", "url", url)
 				return toDelete, false
 			}
 			toDelete = append(toDelete, toEvict.Key)
 			room += toEvict.Size
 		}
 	}
+
+	//Make sure the entry fits within the entry count limit
+	if c.maxEntries > 0 {
+		for len(c.cache)+c.pendingEntries-len(toDelete) >= c.maxEntries {
+			toEvict := c.policy.Evict()
+			if toEvict == nil {
+				Log(CacheComponent).Info("not caching, unable to make room within the entry limit", "url", url, "max_entries", c.maxEntries)
+				return toDelete, false
+			}
+			toDelete = append(toDelete, toEvict.Key)
+		}
+	}
 	c.pendingSet += length
+	c.pendingEntries++
+	for _, q := range quotas {
+		q.pending += length
+	}
 	return toDelete, true
 }
 
@@ -99,14 +310,32 @@ func (c *WebCache) Delete(key string) {
 	defer c.Unlock()
 
 	if c.cache[key] != nil {
+		c.policy.Remove(c.cache[key])
 		size := c.cache[key].Size
+		for _, q := range c.entryQuotas(c.cache[key]) {
+			q.current -= size
+		}
 		delete(c.cache, key)
 		c.currentCapacity -= size
-		log.Println(fmt.Sprintf("EVICT - %s", key))
+		Log(CacheComponent).Debug("evict", "key", key)
 		c.PrintCapacity()
 	}
 }
 
+// Release gives back the capacity and entry FindEvictionEntries reserved for
+// a response that will not be Set, such as one that could not be saved.
+func (c *WebCache) Release(url string, value Value, contentType string) {
+	c.Lock()
+	defer c.Unlock()
+	length := EntrySize(value)
+	c.pendingSet -= length
+	c.pendingEntries--
+	for _, q := range c.matchingQuotas(url, contentType) {
+		q.release(length)
+	}
+	Log(CacheComponent).Debug("release", "url", url, "bytes", length)
+}
+
 func (c *WebCache) Set(url string, value *Response) {
 	c.Lock()
 	defer c.Unlock()
@@ -114,13 +343,31 @@ func (c *WebCache) Set(url string, value *Response) {
 	entry := NewEntry(hash, value)
 
 	//Only add to the cache size if the entry isn't in the cache already
+	quotas := c.entryQuotas(entry)
 	if c.cache[hash] == nil {
 		c.currentCapacity += entry.Size
 		c.pendingSet -= entry.Size
-		log.Println(fmt.Sprintf("SET - URL: %s Key: %s", url, hash))
+		c.pendingEntries--
+		for _, q := range quotas {
+			q.current += entry.Size
+			q.release(entry.Size)
+		}
+		Log(CacheComponent).Debug("set", "url", url, "key", hash)
 	} else {
-		log.Println(fmt.Sprintf("UPDATE - URL: %s Key: %s", url, hash))
+		Log(CacheComponent).Debug("update", "url", url, "key", hash)
+		old := c.cache[hash]
+		c.policy.Remove(old)
+		//The refreshed entry may differ in size and quotas from the old one
+		c.currentCapacity += entry.Size - old.Size
 		c.pendingSet -= entry.Size
+		c.pendingEntries--
+		for _, q := range c.entryQuotas(old) {
+			q.current -= old.Size
+		}
+		for _, q := range quotas {
+			q.current += entry.Size
+			q.release(entry.Size)
+		}
 	}
 	c.cache[hash] = entry
 	c.promote(entry)
@@ -128,19 +375,82 @@ func (c *WebCache) Set(url string, value *Response) {
 }
 
 func (c *WebCache) Initialize(key string, value *Response) {
-	log.Println(fmt.Sprintf("Adding disk cache entry to web cache. Key: %s", key))
+	Log(CacheComponent).Debug("initialize", "key", key, "url", value.URL)
 	entry := NewEntry(key, value)
 	c.cache[key] = entry
 	c.currentCapacity += entry.Size
+	for _, q := range c.entryQuotas(entry) {
+		q.current += entry.Size
+	}
 	c.promote(entry)
 }
 
+// Admit caches body for url in both wc and dc, first evicting from both
+// the entries that wc's policy and limits choose to make room. It reports
+// whether the response was cached; a response is only added to wc once it
+// has been saved to disk.
+func Admit(wc Cache, dc *DiskCache, url string, body Value, contentType string) (bool, error) {
+	//Find out what needs to be deleted
+	toDelete, shouldCache := wc.FindEvictionEntries(url, body, contentType)
+
+	//Delete from disk, then from web cache
+	for _, key := range toDelete {
+		dc.Remove(key)
+		wc.Delete(key)
+	}
+
+	if !shouldCache {
+		return false, nil
+	}
+	stored := time.Now()
+	expiration := stored.Add(wc.TTL(url, contentType))
+	err := dc.Put(&DiskCacheEntry{
+		Key:            Hash(url),
+		URL:            url,
+		Value:          body,
+		ContentType:    contentType,
+		ExpirationTime: expiration,
+		StoredTime:     stored,
+	})
+	if err != nil {
+		wc.Release(url, body, contentType)
+		return false, err
+	}
+	wc.Set(url, &Response{
+		URL:            url,
+		Body:           body,
+		ContentType:    contentType,
+		ExpirationTime: expiration,
+		StoredTime:     stored,
+	})
+	return true, nil
+}
+
+func (c *WebCache) matchingQuotas(url string, contentType string) (quotas []*quotaUsage) {
+	for _, q := range c.quotas {
+		if q.Matches(url, contentType) {
+			quotas = append(quotas, q)
+		}
+	}
+	return quotas
+}
+
+func (c *WebCache) entryQuotas(entry *Entry) []*quotaUsage {
+	return c.matchingQuotas(entry.URL, entry.ContentType)
+}
+
 func (c *WebCache) promote(entry *Entry) {
 	c.policy.Promote(entry)
 }
 
 func (c *WebCache) PrintCapacity() {
 	CacheStatus(c.currentCapacity, c.maxCapacity)
+	if c.maxEntries > 0 {
+		EntryStatus(len(c.cache), c.maxEntries)
+	}
+	for _, q := range c.quotas {
+		QuotaStatus(q.String(), q.current, q.Limit(c.maxCapacity))
+	}
 }
 
 func Hash(key string) string {
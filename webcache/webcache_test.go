@@ -0,0 +1,124 @@
+package webcache
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func Test_WebCache_Max_Entries(t *testing.T) {
+	for _, policy := range []Policy{NewLRUPolicy(), NewLFUPolicy()} {
+		c := NewWebCache(policy, 1, 60, 2, nil).(*WebCache)
+		for _, url := range []string{"http://a.com/1", "http://a.com/2", "http://a.com/3"} {
+			toDelete, ok := c.FindEvictionEntries(url, Value("x"), "text/plain")
+			for _, key := range toDelete {
+				c.Delete(key)
+			}
+			if !ok {
+				t.Fatalf("Expected %s to be cached", url)
+			}
+			c.Set(url, &Response{URL: url, Body: Value("x"), ExpirationTime: time.Now().Add(time.Minute)})
+		}
+
+		if len(c.cache) != 2 {
+			t.Errorf("Expected 2 entries, got %d", len(c.cache))
+		}
+		if _, ok := c.cache[Hash("http://a.com/1")]; ok {
+			t.Errorf("Expected the first entry to be evicted")
+		}
+		if c.currentCapacity != 2*EntrySize(Value("x")) {
+			t.Errorf("Expected overhead to be accounted, got %d bytes", c.currentCapacity)
+		}
+	}
+}
+
+func Test_WebCache_Max_Entries_Pending(t *testing.T) {
+	for _, policy := range []Policy{NewLRUPolicy(), NewLFUPolicy()} {
+		c := NewWebCache(policy, 1, 60, 1, nil).(*WebCache)
+		//The first entry is still being saved, so there is nothing to evict
+		_, ok := c.FindEvictionEntries("http://a.com/1", Value("x"), "text/plain")
+		if !ok {
+			t.Fatalf("Expected the first entry to be admitted")
+		}
+		toDelete, ok := c.FindEvictionEntries("http://a.com/2", Value("x"), "text/plain")
+		if ok || len(toDelete) != 0 {
+			t.Errorf("Expected the second entry to be refused while the first is pending, got %v, %v", toDelete, ok)
+		}
+	}
+}
+
+func Test_WebCache_Refresh(t *testing.T) {
+	c := NewWebCache(NewLRUPolicy(), 1, 60, 0, []Quota{video(t)}).(*WebCache)
+	set := func(size int, contentType string) {
+		body := make(Value, size)
+		if _, ok := c.FindEvictionEntries("http://a.com/v", body, contentType); !ok {
+			t.Fatalf("Expected %d bytes to be cached", size)
+		}
+		c.Set("http://a.com/v", &Response{URL: "http://a.com/v", Body: body, ContentType: contentType, ExpirationTime: time.Now().Add(time.Minute)})
+	}
+
+	set(1000, "video/mp4")
+	set(10, "video/mp4")
+	if c.currentCapacity != EntrySize(make(Value, 10)) || c.quotas[0].current != EntrySize(make(Value, 10)) {
+		t.Errorf("Expected the refreshed size to be accounted, got %d bytes and %d bytes of video", c.currentCapacity, c.quotas[0].current)
+	}
+	set(100, "text/plain")
+	if c.currentCapacity != EntrySize(make(Value, 100)) || c.quotas[0].current != 0 {
+		t.Errorf("Expected the entry to leave the video quota, got %d bytes and %d bytes of video", c.currentCapacity, c.quotas[0].current)
+	}
+	if c.pendingSet != 0 || c.pendingEntries != 0 || c.quotas[0].pending != 0 {
+		t.Errorf("Expected no reservations left, got %d bytes, %d entries, %d bytes of quota", c.pendingSet, c.pendingEntries, c.quotas[0].pending)
+	}
+}
+
+// failingStore fails to save any entry.
+type failingStore struct {
+	Store
+}
+
+func (s *failingStore) Put(key string, value []byte) error {
+	return errors.New("disk full")
+}
+
+func Test_Admit_Store_Failure(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "admit")
+	defer os.RemoveAll(dir)
+	quota, _ := ParseQuota("type:text/*=50%")
+	wc := NewWebCache(NewLRUPolicy(), 1, 60, 2, []Quota{quota}).(*WebCache)
+	dc := NewDiskCache(&failingStore{NewMemoryStore()}, path.Join(dir, "failing.log"), 0)
+	defer dc.Close()
+
+	for i := 0; i < 3; i++ {
+		cached, err := Admit(wc, dc, "http://a.com/1", Value("x"), "text/plain")
+		if cached || err == nil {
+			t.Fatalf("Expected saving to fail, got %v, %v", cached, err)
+		}
+	}
+	if wc.pendingSet != 0 || wc.pendingEntries != 0 || wc.quotas[0].pending != 0 {
+		t.Errorf("Expected the reservations to be released, got %d bytes, %d entries, %d bytes of quota", wc.pendingSet, wc.pendingEntries, wc.quotas[0].pending)
+	}
+
+	dc2 := NewDiskCache(NewMemoryStore(), path.Join(dir, "journal.log"), 0)
+	defer dc2.Close()
+	for _, url := range []string{"http://a.com/1", "http://a.com/2"} {
+		cached, err := Admit(wc, dc2, url, Value("x"), "text/plain")
+		if !cached || err != nil {
+			t.Errorf("Expected %s to be cached after the failures, got %v, %v", url, cached, err)
+		}
+	}
+
+	//The age of an entry does not depend on the TTL rules
+	response, err := wc.Get(Hash("http://a.com/1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if age := time.Since(response.StoredTime); age < 0 || age > time.Minute {
+		t.Errorf("Expected the entry to record when it was stored, got %s", response.StoredTime)
+	}
+	if response.ExpirationTime.Sub(response.StoredTime) != wc.TTL("http://a.com/1", "text/plain") {
+		t.Errorf("Expected the entry to expire a TTL after it was stored, got %s and %s", response.StoredTime, response.ExpirationTime)
+	}
+}